@@ -2,35 +2,66 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/isyangban/gdbox/lib"
 )
 
-var kMetadata = make(map[string]Metadata)
 var kConfig = new(Config)
 
+// kConfigPath is the file kConfig was loaded from, where logins and
+// refreshed tokens are saved. Nothing is saved when it is "".
+var kConfigPath string
+
+// kStateDir holds journals and caches, by default .gdbox next to the
+// configuration file. The config file can move it with state_dir.
+var kStateDir string
+
 func main() {
 	home := os.Getenv("HOME")
 	config_path := flag.String("c", home+"/.godropbox.conf", "set configuration file `path`")
+	profile := flag.String("profile", "", "use the account and settings of profile `name`, GDBOX_PROFILE by default")
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Gdbox is a command line tool for managing dropbox")
-		fmt.Fprintln(os.Stderr, "Usage:\n\n\tgdbox [flags] command [arguments...]\n")
-		fmt.Fprintln(os.Stderr, "The commands and arguments are:\n")
-		fmt.Fprintln(os.Stderr, "\tdownload [src] [dst]\t\tdownload files/folders from dropbox")
-		fmt.Fprintln(os.Stderr, "\tupload [src] [dst]\t\tupload files/folders to dropbox")
-		fmt.Fprintln(os.Stderr, "\tfind [path] [expression]\tsearch for files in dropbox")
+		fmt.Fprint(os.Stderr, "Usage:\n\n\tgdbox [flags] command [arguments...]\n\n")
+		fmt.Fprint(os.Stderr, "The commands and arguments are:\n\n")
+		fmt.Fprintln(os.Stderr, "\tdownload [flags] [src] [dst]\tdownload files/folders from dropbox")
+		fmt.Fprintln(os.Stderr, "\tupload [flags] [src] [dst]\tupload files/folders to dropbox")
+		fmt.Fprintln(os.Stderr, "\tverify [flags] [local] [remote]\tcompare local files with dropbox")
+		fmt.Fprintln(os.Stderr, "\tsync [flags] [local] [remote]\tsync a local folder with dropbox both ways")
+		fmt.Fprintln(os.Stderr, "\tmirror [flags] up|down [src] [dst]\tmake dst an exact copy of src")
+		fmt.Fprintln(os.Stderr, "\tfind [flags] [path] [expression]\tsearch for files in dropbox")
+		fmt.Fprintln(os.Stderr, "\tdu [flags] [path]\t\tshow the size of folders in dropbox")
+		fmt.Fprintln(os.Stderr, "\twatch [flags] [path]\t\tprint changes in dropbox as they happen")
+		fmt.Fprintln(os.Stderr, "\tlogin [flags]\t\t\tlog in to dropbox")
+		fmt.Fprintln(os.Stderr, "\tlogout [flags]\t\t\trevoke the token and remove it with the caches")
+		fmt.Fprintln(os.Stderr, "\tprofile list|add|remove|default [name]\tmanage the accounts of the config")
+		fmt.Fprintln(os.Stderr, "\tconfig encrypt|decrypt\t\tencrypt the tokens of the config with a passphrase")
+		fmt.Fprintln(os.Stderr, "\tcheck-ignore [flags] [path...]\ttell which rule ignores local files")
 		fmt.Fprintln(os.Stderr, "\tmv [src] [dst]\t\t\tmove files")
 		fmt.Fprintln(os.Stderr, "\tcp [src] [dst]\t\t\tcopy files")
 		fmt.Fprintln(os.Stderr, "\tmkdir [path]\t\t\tmake a folder")
 		fmt.Fprintln(os.Stderr, "\tls [file]\t\t\tlist files/folders in dropbox")
 		fmt.Fprintln(os.Stderr, "\trm [file]\t\t\tdelete files")
-		fmt.Fprintln(os.Stderr, "\nThe (optional) flags are:\n")
+		fmt.Fprint(os.Stderr, "\nCommand flags are listed by gdbox command -h.\n")
+		fmt.Fprint(os.Stderr, "\nThe (optional) flags are:\n\n")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
@@ -42,99 +73,518 @@ func main() {
 		flag.Usage()
 		return
 	} else {
-		err := kConfig.LoadFile(*config_path)
-		defer kConfig.SaveFile(*config_path)
-		if err != nil {
+		kStateDir = filepath.Join(filepath.Dir(*config_path), ".gdbox")
+		kConfigPath = *config_path
+		var err error
+		if kConfig, err = loadConfig(*config_path, *profile, flag.Arg(0)); err != nil {
 			fmt.Println(err)
 			return
 		}
-		if kConfig.AccessToken == "" {
-			token := Setup()
-			kConfig.AccessToken = token.AccessToken
+		// Ctrl-C cancels in-flight requests, a second one kills the process
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			stop()
+		}()
+		handler(ctx, flag.CommandLine)
+		if ctx.Err() != nil {
+			fmt.Fprintln(os.Stderr, "Interrupted")
 		}
-		handler(flag.CommandLine)
 	}
 }
 
 type Config struct {
 	AccessToken string `json:"access_token"`
+	// Gets new access tokens, which expire at TokenExpiry in unix time
+	RefreshToken string `json:"refresh_token,omitempty"`
+	TokenExpiry  int64  `json:"token_expiry,omitempty"`
+	// Instead of the tokens, when they are encrypted, see secret.go
+	SealedTokens     []byte           `json:"sealed_tokens,omitempty"`
+	Encryption       *tokenEncryption `json:"encryption,omitempty"`
+	CredentialHelper string           `json:"credential_helper,omitempty"`
+	// App gdbox logs in as, its key is not a secret
+	AppKey      string `json:"app_key,omitempty"`
+	ApiHost     string `json:"api_host,omitempty"`
+	ContentHost string `json:"content_host,omitempty"`
+	NotifyHost  string `json:"notify_host,omitempty"`
+	StateDir    string `json:"state_dir,omitempty"`
+	Workers     int    `json:"workers,omitempty"`
+	// Chunked uploads, chunk size in MiB
+	ChunkSize    int64 `json:"chunk_size,omitempty"`
+	ChunkWorkers int   `json:"chunk_workers,omitempty"`
+	// Gitignore style patterns of files never transferred
+	Ignore []string `json:"ignore,omitempty"`
+	// Folders listed at once by tree walks
+	ListWorkers int `json:"list_workers,omitempty"`
+	// Bound of the listing cache in MiB, negative to disable it
+	CacheSize int64 `json:"cache_size,omitempty"`
+	// Other accounts, with settings of their own, see Profile
+	Profiles       map[string]*Config `json:"profiles,omitempty"`
+	DefaultProfile string             `json:"default_profile,omitempty"`
+
+	profile      string // name, "" for the default profile
+	shared_state string // state_dir of the top level
 }
 
-func (c *Config) ToToken() *Token {
-	token := Token{
-		AccessToken: c.AccessToken,
+// Environment variables overriding the api base urls of the config file
+const (
+	kEnvApiHost     = "GDBOX_API_URL"
+	kEnvContentHost = "GDBOX_CONTENT_URL"
+	kEnvNotifyHost  = "GDBOX_NOTIFY_URL"
+)
+
+// NewDropbox returns a client for the configured account. Base urls are
+// taken from the environment first, then the config file.
+func (c *Config) NewDropbox() *lib.Dropbox {
+	dbox := lib.NewDropbox(*c.ToToken())
+	dbox.AppKey = c.AppKey
+	if kConfigPath != "" {
+		dbox.Store = configStore{kConfigPath, kProfile}
+	}
+	setHost(&dbox.ApiHost, kEnvApiHost, c.ApiHost)
+	setHost(&dbox.ContentHost, kEnvContentHost, c.ContentHost)
+	setHost(&dbox.NotifyHost, kEnvNotifyHost, c.NotifyHost)
+	if dir := c.stateDir(); dir != "" {
+		dbox.Journal = &lib.UploadJournal{Dir: filepath.Join(dir, "uploads")}
+		if c.CacheSize >= 0 {
+			dbox.Cache = &lib.MetadataCache{Dir: filepath.Join(dir, "cache"), MaxBytes: c.CacheSize << 20}
+		}
+	}
+	if c.Workers > 0 {
+		dbox.Workers = c.Workers
+	}
+	dbox.ChunkSize = c.ChunkSize << 20
+	if c.ChunkWorkers > 0 {
+		dbox.ChunkWorkers = c.ChunkWorkers
+	}
+	if c.ListWorkers > 0 {
+		dbox.ListWorkers = c.ListWorkers
+	}
+	dbox.Filter = lib.NewFilter()
+	dbox.Filter.Global(c.Ignore...)
+	return dbox
+}
+
+func setHost(host *string, env string, config_host string) {
+	if value := os.Getenv(env); value != "" {
+		*host = value
+	} else if config_host != "" {
+		*host = config_host
+	}
+}
+
+func (c *Config) ToToken() *lib.Token {
+	token := lib.Token{
+		AccessToken:  c.AccessToken,
+		RefreshToken: c.RefreshToken,
+	}
+	if c.TokenExpiry != 0 {
+		token.Expiry = time.Unix(c.TokenExpiry, 0)
 	}
 	return &token
 }
 
+// setToken keeps a token from a login or a refresh.
+func (c *Config) setToken(token lib.Token) {
+	c.AccessToken = token.AccessToken
+	c.RefreshToken = token.RefreshToken
+	c.TokenExpiry = 0
+	if !token.Expiry.IsZero() {
+		c.TokenExpiry = token.Expiry.Unix()
+	}
+}
+
+// loadConfig reads the config file and returns the settings of the
+// profile that command runs with, setting kProfile.
+func loadConfig(config_path string, flag_profile string, command string) (*Config, error) {
+	config := new(Config)
+	err := config.LoadFile(config_path)
+	// login and profile make the configuration file, check-ignore
+	// does without
+	if err != nil && !(errors.Is(err, errNoConfig) && !needsLogin(command)) {
+		return nil, err
+	}
+	kProfile = profileName(flag_profile, config)
+	env_token := os.Getenv(kEnvToken)
+	if env_token != "" && command == "logout" {
+		// It would revoke the token of the environment and drop the
+		// stored ones unrevoked
+		return nil, fmt.Errorf("%s is set, unset it to log out of the profile %s", kEnvToken, profileLabel(kProfile))
+	}
+	// The stored tokens are not used with GDBOX_TOKEN, no passphrase
+	// is needed
+	if needsLogin(command) && env_token == "" {
+		if err := config.openTokens(kProfile); err != nil {
+			return nil, err
+		}
+	}
+	profile, err := config.Profile(kProfile, !needsLogin(command))
+	if err != nil {
+		return nil, err
+	}
+	if env_token != "" {
+		// Not refreshed nor saved
+		profile.setToken(lib.Token{AccessToken: env_token})
+	}
+	// logout still clears what a lost login left behind
+	if profile.AccessToken == "" && needsLogin(command) && command != "logout" {
+		return nil, errors.New("Not logged in, run " + os.Args[0] + " login first")
+	}
+	return profile, nil
+}
+
+// needsLogin reports whether command uses the token of the profile.
+func needsLogin(command string) bool {
+	switch command {
+	case "login", "profile", "config", "check-ignore":
+		return false
+	}
+	return true
+}
+
+// commandFlags returns the flag set for the flags of a command, which
+// follow the command name: gdbox download -continue src dst
+func commandFlags(name string) *flag.FlagSet {
+	return flag.NewFlagSet(os.Args[0]+" "+name, flag.ContinueOnError)
+}
+
 // Change hanlder to handler -> handlerdownlaod, handler upload etc...
-func handler(flag *flag.FlagSet) {
+func handler(ctx context.Context, flag *flag.FlagSet) {
 	command := flag.Arg(0)
-	client := &http.Client{}
+	dbox := kConfig.NewDropbox()
+	defer reportRetries(dbox)
 	switch command {
 	case "download":
-		if !(flag.NArg() == 2 || flag.NArg() == 3) {
+		cmd := commandFlags("download")
+		resume := cmd.Bool("continue", false, "continue partial downloads left by an earlier run")
+		cmd.IntVar(&dbox.Workers, "j", dbox.Workers, "download `N` files at a time")
+		filterFlags(cmd, dbox.Filter)
+		if cmd.Parse(flag.Args()[1:]) != nil {
+			return
+		}
+		if !(cmd.NArg() == 1 || cmd.NArg() == 2) {
 			fmt.Println("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
 			return
 		}
-		default_argument := flag.Arg(2)
-		if flag.NArg() == 2 {
+		download := dbox.DownloadContext
+		if *resume {
+			download = dbox.DownloadResumeContext
+		}
+		default_argument := cmd.Arg(1)
+		if cmd.NArg() == 1 {
 			default_argument = "."
 		}
-		metadata, err := GetMetadata(client, flag.Arg(1), kConfig.ToToken())
+		metadata, err := dbox.StatContext(ctx, cmd.Arg(0))
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
-		if metadata.IsDir {
-			file_list := metadata.FileList(100, 0)
-			for _, file := range file_list {
-				fmt.Println("Downloading " + file + " to " + default_argument + file)
-				err := Download(client, file, default_argument+file, kConfig.ToToken())
-				if err != nil {
-					fmt.Println(err)
-				}
-			}
-		} else {
-			fmt.Println("Downloading " + flag.Arg(1) + " to " + default_argument)
-			err := Download(client, flag.Arg(1), default_argument, kConfig.ToToken())
-			if err != nil {
-				fmt.Println(err)
+		transfer := func(file string, dst string) lib.Transfer {
+			return lib.Transfer{
+				Name: file + " to " + dst,
+				Run:  func(ctx context.Context) (string, error) { return "", download(ctx, file, dst) },
 			}
 		}
+		total := 0
+		err = lib.StreamTransfers(ctx, func(add func(lib.Transfer) error) error {
+			if !metadata.IsDir {
+				return add(transfer(cmd.Arg(0), default_argument))
+			}
+			return dbox.WalkContext(ctx, cmd.Arg(0), func(entry lib.Metadata) error {
+				// Ignore files are looked up where the file would go
+				if dbox.Filter.Ignores(default_argument, strings.TrimPrefix(entry.Path, "/"), entry.IsDir) {
+					return filepath.SkipDir
+				}
+				if entry.Tag != "file" {
+					return nil
+				}
+				return add(transfer(entry.Path, default_argument+entry.Path))
+			})
+		}, dbox.Workers, countTransfers("Downloaded", &total))
+		printTransferSummary("downloaded", total, err)
 	case "upload":
-		if flag.NArg() != 3 {
+		cmd := commandFlags("upload")
+		resume := cmd.Bool("resume", false, "resume chunked uploads left by an earlier run")
+		cmd.IntVar(&dbox.Workers, "j", dbox.Workers, "upload `N` files at a time")
+		chunk_size := cmd.Int64("chunk-size", dbox.ChunkSize>>20, "split large files in chunks of `MiB` mebibytes")
+		cmd.IntVar(&dbox.ChunkWorkers, "chunk-j", dbox.ChunkWorkers, "send `N` chunks of a large file at a time")
+		policy := cmd.String("policy", "overwrite", "when a file exists: "+policyNames())
+		cmd.StringVar(&dbox.ExpectedRev, "rev", "", "with -policy update, only replace the remote file if it is still `REV`, for a single file")
+		filterFlags(cmd, dbox.Filter)
+		if cmd.Parse(flag.Args()[1:]) != nil || !setPolicy(dbox, *policy) {
+			return
+		}
+		if cmd.NArg() != 2 {
+			fmt.Println("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
+			return
+		}
+		if dbox.ExpectedRev != "" && dbox.Policy != lib.PolicyUpdate {
+			fmt.Println("-rev needs -policy update")
+			return
+		}
+		dbox.ChunkSize = *chunk_size << 20
+		upload := dbox.UploadContext
+		if *resume {
+			upload = dbox.UploadResumeContext
+		}
+		total := 0
+		dbox.Report = countTransfers("Uploaded", &total)
+		err := upload(ctx, cmd.Arg(1), cmd.Arg(0))
+		var transfer_err *lib.TransferError
+		if err != nil && !errors.As(err, &transfer_err) {
+			fmt.Println(err)
+			return
+		}
+		printTransferSummary("uploaded", total, err)
+	case "verify":
+		cmd := commandFlags("verify")
+		cmd.IntVar(&dbox.Workers, "j", dbox.Workers, "hash `N` files at a time")
+		if cmd.Parse(flag.Args()[1:]) != nil {
+			return
+		}
+		if cmd.NArg() != 2 {
+			fmt.Println("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
+			return
+		}
+		stat, err := os.Stat(cmd.Arg(0))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		// Remote paths are laid out as upload would
+		total := 0
+		err = lib.StreamTransfers(ctx, func(add func(lib.Transfer) error) error {
+			return lib.WalkFiles(cmd.Arg(0), dbox.Filter, func(file string, rel string) error {
+				remote := cmd.Arg(1)
+				if stat.IsDir() || strings.HasSuffix(remote, "/") {
+					remote = strings.TrimSuffix(remote, "/") + "/" + rel
+				}
+				return add(lib.Transfer{
+					Name: file + " against " + remote,
+					Run:  func(ctx context.Context) (string, error) { return "", dbox.VerifyContext(ctx, remote, file) },
+				})
+			})
+		}, dbox.Workers, countTransfers("Verified", &total))
+		printTransferSummary("verified", total, err)
+	case "sync":
+		cmd := commandFlags("sync")
+		cmd.IntVar(&dbox.Workers, "j", dbox.Workers, "transfer `N` files at a time")
+		policy := cmd.String("policy", "rename", "when a file changed on both sides: "+policyNames())
+		filterFlags(cmd, dbox.Filter)
+		if cmd.Parse(flag.Args()[1:]) != nil || !setPolicy(dbox, *policy) {
+			return
+		}
+		if cmd.NArg() != 2 {
+			fmt.Println("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
+			return
+		}
+		state_path, err := syncStatePath(cmd.Arg(0), cmd.Arg(1))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		state, err := lib.LoadSyncState(state_path)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		total := 0
+		dbox.Report = countTransfers("Done", &total)
+		err = dbox.SyncContext(ctx, cmd.Arg(0), cmd.Arg(1), state)
+		var transfer_err *lib.TransferError
+		if err != nil && !errors.As(err, &transfer_err) {
+			fmt.Println(err)
+			return
+		}
+		printTransferSummary("synced", total, err)
+	case "mirror":
+		cmd := commandFlags("mirror")
+		dry_run := cmd.Bool("dry-run", false, "print the plan without changing anything")
+		cmd.IntVar(&dbox.Workers, "j", dbox.Workers, "transfer `N` files at a time")
+		filterFlags(cmd, dbox.Filter)
+		if cmd.Parse(flag.Args()[1:]) != nil {
+			return
+		}
+		// mirror up [local] [remote], mirror down [remote] [local]
+		if cmd.NArg() != 3 || (cmd.Arg(0) != "up" && cmd.Arg(0) != "down") {
 			fmt.Println("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
 			return
 		}
-		err := Upload(client, flag.Arg(2), flag.Arg(1), kConfig.ToToken())
+		upload := cmd.Arg(0) == "up"
+		local_path, remote_path := cmd.Arg(1), cmd.Arg(2)
+		if !upload {
+			local_path, remote_path = remote_path, local_path
+		}
+		plan, err := dbox.PlanMirrorContext(ctx, local_path, remote_path, upload)
 		if err != nil {
-			fmt.Println(nil)
+			fmt.Println(err)
 			return
 		}
+		if *dry_run {
+			printMirrorPlan(plan)
+			return
+		}
+		dbox.Report = printTransfer("Done")
+		err = dbox.MirrorContext(ctx, plan)
+		var transfer_err *lib.TransferError
+		if err != nil && !errors.As(err, &transfer_err) {
+			fmt.Println(err)
+			return
+		}
+		printTransferSummary("mirrored", len(plan.Ops), err)
 	case "find":
-		if flag.NArg() != 3 {
+		cmd := commandFlags("find")
+		filterFlags(cmd, dbox.Filter)
+		if cmd.Parse(flag.Args()[1:]) != nil {
+			return
+		}
+		if cmd.NArg() != 2 {
+			fmt.Println("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
+			return
+		}
+		err := dbox.WalkContext(ctx, cmd.Arg(0), func(entry lib.Metadata) error {
+			// No ignore files, the tree is not local
+			if dbox.Filter.Ignores("", remoteRel(cmd.Arg(0), entry.Path), entry.IsDir) {
+				return filepath.SkipDir
+			}
+			if matchName(cmd.Arg(1), entry.Name) {
+				fmt.Println(entry.Path)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Println(err)
+		}
+	case "du":
+		cmd := commandFlags("du")
+		filterFlags(cmd, dbox.Filter)
+		if cmd.Parse(flag.Args()[1:]) != nil {
+			return
+		}
+		if cmd.NArg() > 1 {
+			fmt.Println("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
+			return
+		}
+		root := cmd.Arg(0)
+		if root == "" {
+			root = "/"
+		}
+		if err := diskUsage(ctx, dbox, root); err != nil {
+			fmt.Println(err)
+		}
+	case "watch":
+		cmd := commandFlags("watch")
+		as_json := cmd.Bool("json", false, "print events as json objects, one per line")
+		command := cmd.String("exec", "", "run `command` with sh for every event, with GDBOX_EVENT and GDBOX_PATH set")
+		filterFlags(cmd, dbox.Filter)
+		if cmd.Parse(flag.Args()[1:]) != nil {
+			return
+		}
+		if cmd.NArg() > 1 {
 			fmt.Println("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
 			return
 		}
-		metadata, err := Search(client, flag.Arg(1), flag.Arg(2), kConfig.ToToken())
+		root := cmd.Arg(0)
+		err := dbox.WatchContext(ctx, root, func(event lib.WatchEvent) error {
+			if dbox.Filter.Ignores("", remoteRel(root, event.Path), event.Entry.IsDir) {
+				return nil
+			}
+			printWatchEvent(event, *as_json)
+			if *command != "" {
+				runEventCommand(ctx, *command, event)
+			}
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			fmt.Println(err)
+		}
+	case "login":
+		cmd := commandFlags("login")
+		app_key := cmd.String("app-key", kConfig.AppKey, "log in as the dropbox app with this `key`")
+		port := cmd.Int("port", kLoginPort, "listen for the redirect on this `port` of 127.0.0.1")
+		manual := cmd.Bool("manual", false, "paste the code instead of listening for the redirect")
+		if cmd.Parse(flag.Args()[1:]) != nil {
+			return
+		}
+		if cmd.NArg() != 0 {
+			fmt.Println("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
+			return
+		}
+		if *app_key == "" {
+			fmt.Println("Create a Dropbox app at https://www.dropbox.com/developers/apps/create,")
+			fmt.Printf("add http://127.0.0.1:%d/callback to its redirect URIs and enter its app key.\n", *port)
+			fmt.Print("App key: ")
+			fmt.Scanln(app_key)
+			if *app_key = strings.TrimSpace(*app_key); *app_key == "" {
+				return
+			}
+		}
+		if err := login(ctx, dbox, *app_key, *port, *manual); err != nil {
+			fmt.Println(err)
+			return
+		}
+		kConfig.AppKey = *app_key
+		kConfig.setToken(dbox.Token)
+		err := updateConfig(kConfigPath, func(c *Config) error {
+			section := c.section(kProfile)
+			section.AppKey = *app_key
+			section.setToken(dbox.Token)
+			return nil
+		})
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
-		for _, m := range metadata {
-			fmt.Println(m.Path)
+		if account, err := dbox.GetAccountContext(ctx); err == nil {
+			fmt.Println("Logged in as " + account.Name.DisplayName + " <" + account.Email + ">")
+		} else {
+			fmt.Println("Logged in")
+		}
+	case "logout":
+		cmd := commandFlags("logout")
+		local := cmd.Bool("local", false, "only remove the token here, without revoking it")
+		if cmd.Parse(flag.Args()[1:]) != nil {
+			return
+		}
+		if cmd.NArg() != 0 {
+			fmt.Println("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
+			return
+		}
+		if err := logout(ctx, dbox, *local); err != nil {
+			fmt.Println(err)
+		}
+	case "profile":
+		if err := profileCommand(flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+		}
+	case "config":
+		if err := configCommand(flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+		}
+	case "check-ignore":
+		cmd := commandFlags("check-ignore")
+		filterFlags(cmd, dbox.Filter)
+		if cmd.Parse(flag.Args()[1:]) != nil {
+			return
+		}
+		if cmd.NArg() == 0 {
+			fmt.Println("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
+			return
+		}
+		for _, file := range cmd.Args() {
+			checkIgnore(dbox.Filter, file)
 		}
 	case "ls":
-		if !(flag.NArg() == 2) {
+		if !(flag.NArg() == 1 || flag.NArg() == 2) {
 			fmt.Println("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
 			return
 		}
 		default_argument := flag.Arg(1)
 		if flag.NArg() == 1 {
-			default_argument = "."
+			default_argument = "/"
 		}
-		metadata, err := GetMetadata(client, default_argument, kConfig.ToToken())
+		metadata, err := dbox.GetMetaDataContext(ctx, default_argument)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -143,22 +593,22 @@ func handler(flag *flag.FlagSet) {
 	/*case "shell":
 	fmt.Println("Starting Dropbox shell...")*/
 	case "mv":
-		if flag.NArg() != 2 {
+		if flag.NArg() != 3 {
 			fmt.Println("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
 			return
 		}
-		_, err := Move(client, flag.Arg(1), flag.Arg(2), kConfig.ToToken())
+		_, err := dbox.MoveContext(ctx, flag.Arg(1), flag.Arg(2))
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
 		fmt.Println("Move operation successful")
 	case "cp":
-		if flag.NArg() != 2 {
+		if flag.NArg() != 3 {
 			fmt.Println("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
 			return
 		}
-		_, err := Copy(client, flag.Arg(1), flag.Arg(2), kConfig.ToToken())
+		_, err := dbox.CopyContext(ctx, flag.Arg(1), flag.Arg(2))
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -171,13 +621,14 @@ func handler(flag *flag.FlagSet) {
 		}
 		fmt.Print("Are you sure you wan't to delete " + flag.Arg(1) + "(y/n)")
 		var answer string
-		fmt.Scanf("%c", &answer)
-		if strings.ToLower(answer) == "y" {
-			_, err := Delete(client, flag.Arg(1), kConfig.ToToken())
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
+		fmt.Scanln(&answer)
+		if strings.ToLower(answer) != "y" {
+			return
+		}
+		_, err := dbox.DeleteContext(ctx, flag.Arg(1))
+		if err != nil {
+			fmt.Println(err)
+			return
 		}
 		fmt.Println("Delete operation successful")
 	case "mkdir":
@@ -185,7 +636,7 @@ func handler(flag *flag.FlagSet) {
 			fmt.Println("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
 			return
 		}
-		_, err := CreateFolder(client, flag.Arg(1), kConfig.ToToken())
+		_, err := dbox.CreateFolderContext(ctx, flag.Arg(1))
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -197,21 +648,302 @@ func handler(flag *flag.FlagSet) {
 	}
 }
 
-func (c *Config) SaveFile(config_path string) error {
-	output, _ := json.Marshal(c)
-	err := ioutil.WriteFile(config_path, output, 600)
+// filterFlag adds a rule to a filter for each -exclude or -include.
+type filterFlag struct {
+	filter  *lib.Filter
+	include bool
+}
+
+func (f filterFlag) String() string { return "" }
+
+func (f filterFlag) Set(pattern string) error {
+	if f.include {
+		f.filter.Include(pattern)
+	} else {
+		f.filter.Exclude(pattern)
+	}
+	return nil
+}
+
+// filterFlags adds the -exclude and -include flags of a command.
+func filterFlags(cmd *flag.FlagSet, filter *lib.Filter) {
+	cmd.Var(filterFlag{filter, false}, "exclude", "skip files matching the gitignore style `pattern`, repeatable")
+	cmd.Var(filterFlag{filter, true}, "include", "keep files matching `pattern` that would be ignored, repeatable")
+}
+
+// matchName reports whether a file name matches the expression of find:
+// a glob such as *.txt, or words that must all be in the name.
+func matchName(expression string, name string) bool {
+	expression, name = strings.ToLower(expression), strings.ToLower(name)
+	if strings.ContainsAny(expression, "*?[") {
+		ok, _ := path.Match(expression, name)
+		return ok
+	}
+	words := strings.Fields(expression)
+	for _, word := range words {
+		if !strings.Contains(name, word) {
+			return false
+		}
+	}
+	return len(words) > 0
+}
+
+// diskUsage prints the size of each file and folder in root and the
+// total, like du -d 1.
+func diskUsage(ctx context.Context, dbox *lib.Dropbox, root string) error {
+	sizes := make(map[string]int64)
+	names := make(map[string]string)
+	var total int64
+	files := 0
+	err := dbox.WalkContext(ctx, root, func(entry lib.Metadata) error {
+		rel := remoteRel(root, entry.Path)
+		if dbox.Filter.Ignores("", rel, entry.IsDir) {
+			return filepath.SkipDir
+		}
+		top := strings.ToLower(strings.SplitN(rel, "/", 2)[0])
+		if !strings.Contains(rel, "/") {
+			names[top] = entry.Path
+			if entry.IsDir {
+				names[top] += "/"
+			}
+		}
+		if entry.Tag == "file" {
+			sizes[top] += entry.Bytes
+			total += entry.Bytes
+			files++
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
+	var keys []string
+	for key := range names {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%10s  %s\n", lib.FormatSize(sizes[key]), names[key])
+	}
+	fmt.Printf("%10s  total, %d files\n", lib.FormatSize(total), files)
 	return nil
 }
 
+// printWatchEvent prints a line such as "added\t/path", or the event
+// as json.
+func printWatchEvent(event lib.WatchEvent, as_json bool) {
+	if !as_json {
+		fmt.Printf("%s\t%s\n", event.Type, event.Path)
+		return
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Println(string(line))
+}
+
+// runEventCommand runs the -exec command of watch for an event, and
+// reports a failure without stopping the watch.
+func runEventCommand(ctx context.Context, command string, event lib.WatchEvent) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), "GDBOX_EVENT="+event.Type, "GDBOX_PATH="+event.Path)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil && ctx.Err() == nil {
+		fmt.Fprintf(os.Stderr, "%s: %s: %v\n", event.Type, event.Path, err)
+	}
+}
+
+// remoteRel returns the remote path p relative to the folder root.
+func remoteRel(root string, p string) string {
+	root = strings.TrimSuffix(path.Clean("/"+root), "/")
+	if strings.EqualFold(p, root) {
+		return path.Base(p)
+	}
+	if len(p) > len(root) && p[len(root)] == '/' && strings.EqualFold(p[:len(root)], root) {
+		return p[len(root)+1:]
+	}
+	return strings.TrimPrefix(p, "/")
+}
+
+// checkIgnore tells whether a local file is ignored when its folder, or
+// the current folder, is transferred, and by which rule.
+func checkIgnore(filter *lib.Filter, file string) {
+	wd, _ := os.Getwd()
+	abs, _ := filepath.Abs(file)
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		fmt.Println(file + ": outside of the current folder")
+		return
+	}
+	stat, err := os.Stat(file)
+	is_dir := err == nil && stat.IsDir() || strings.HasSuffix(file, "/")
+	ignored, rule := filter.Match(wd, filepath.ToSlash(rel), is_dir)
+	switch {
+	case rule == nil:
+		fmt.Println(file + ": not ignored")
+	case ignored:
+		fmt.Println(file + ": ignored by " + rule.String())
+	default:
+		fmt.Println(file + ": kept by " + rule.String())
+	}
+}
+
+// syncStatePath returns the state file of syncing local_path with
+// remote_path, one per pair of folders.
+func syncStatePath(local_path string, remote_path string) (string, error) {
+	dir := kConfig.stateDir()
+	if dir == "" {
+		return "", errors.New("sync needs a state_dir to keep its state")
+	}
+	abs, err := filepath.Abs(local_path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs + "\x00" + strings.ToLower(path.Clean("/"+remote_path))))
+	return filepath.Join(dir, "sync", hex.EncodeToString(sum[:16])+".json"), nil
+}
+
+// printMirrorPlan lists the steps of a mirror and what they add up to.
+func printMirrorPlan(plan *lib.MirrorPlan) {
+	counts := make(map[string]int)
+	var transfer, remove int64
+	for _, op := range plan.Ops {
+		counts[op.Op]++
+		name, size := op.Path, lib.FormatSize(op.Size)
+		if op.IsDir {
+			name = op.Path + "/"
+			// Only deleted folders have the size of their files
+			if op.Size == 0 {
+				size = ""
+			}
+		}
+		fmt.Printf("%-6s  %s\t%s\n", op.Op, name, size)
+		if op.Op == "delete" {
+			remove += op.Size
+		} else {
+			transfer += op.Size
+		}
+	}
+	fmt.Printf("%d to create, %d to update, %d to delete: %s to transfer, %s to delete\n",
+		counts["create"], counts["update"], counts["delete"], lib.FormatSize(transfer), lib.FormatSize(remove))
+}
+
+// printTransfer returns a RunTransfers report printing one line per file.
+func printTransfer(verb string) func(lib.TransferResult) {
+	return func(result lib.TransferResult) {
+		if result.Err != nil {
+			fmt.Println("Failed " + result.Name + ": " + result.Err.Error())
+		} else if result.Outcome != "" {
+			fmt.Println(result.Name + ": " + result.Outcome)
+		} else {
+			fmt.Println(verb + " " + result.Name)
+		}
+	}
+}
+
+// policyNames lists the conflict policies for flag help.
+func policyNames() string {
+	var names []string
+	for _, policy := range lib.ConflictPolicies {
+		names = append(names, string(policy))
+	}
+	return strings.Join(names, ", ")
+}
+
+// setPolicy sets the conflict policy named by a -policy flag.
+func setPolicy(dbox *lib.Dropbox, name string) bool {
+	policy, err := lib.ParseConflictPolicy(name)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	dbox.Policy = policy
+	return true
+}
+
+// countTransfers is printTransfer counting the transfers in total.
+func countTransfers(verb string, total *int) func(lib.TransferResult) {
+	report := printTransfer(verb)
+	return func(result lib.TransferResult) {
+		*total++
+		report(result)
+	}
+}
+
+// printTransferSummary prints the totals of a RunTransfers call and lists
+// the files that failed once more, so they are not lost in the progress.
+func printTransferSummary(verb string, total int, err error) {
+	var transfer_err *lib.TransferError
+	if !errors.As(err, &transfer_err) {
+		if err != nil {
+			fmt.Println(err)
+		}
+		if total > 1 {
+			fmt.Printf("%d files %s\n", total, verb)
+		}
+		return
+	}
+	fmt.Printf("%d files %s, %d failed:\n", total-len(transfer_err.Failed), verb, len(transfer_err.Failed))
+	for _, result := range transfer_err.Failed {
+		fmt.Println("\t" + result.Name + ": " + result.Err.Error())
+	}
+}
+
+// reportRetries tells how many requests had to be retried, if any.
+func reportRetries(dbox *lib.Dropbox) {
+	stats := dbox.Stats()
+	if stats.Retries > 0 {
+		fmt.Printf("%d of %d requests were retried (%d rate limited)\n", stats.Retries, stats.Requests, stats.RateLimited)
+	}
+}
+
+// SaveFile writes the config to a temporary file renamed over
+// config_path, so readers never see half of it. Only the owner can read
+// it, it holds the tokens. Tokens are first moved out of the plain
+// fields of c when the config keeps them encrypted or in a credential
+// helper.
+func (c *Config) SaveFile(config_path string) error {
+	if err := c.sealTokens(); err != nil {
+		return err
+	}
+	output, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(config_path), filepath.Base(config_path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	// TempFile makes 0600 files, Chmod for umasks that do not
+	err = tmp.Chmod(0600)
+	if err == nil {
+		_, err = tmp.Write(append(output, '\n'))
+	}
+	if close_err := tmp.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), config_path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+var errNoConfig = errors.New("Configuration file does not exist")
+
 func (c *Config) LoadFile(config_path string) error {
 	f, err := os.Open(config_path)
+	if err == nil {
+		defer f.Close()
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
 			//fmt.Println("Configuration file does not exist, making one instead")
-			return errors.New("Configuration file does not exist")
+			return errNoConfig
 			//output, _ := json.Marshal(kConfig)
 			//ioutil.WriteFile(config_path, output, 600)
 		} else {
@@ -234,90 +966,129 @@ func (c *Config) LoadFile(config_path string) error {
 	return nil
 }
 
-func Setup() Token {
-	var (
-		app_key    string
-		secret_key string
-	)
-
-	fmt.Println("You need to complete this setup inorder to use this program")
-	fmt.Println("Open the following URL in your browser and login:", "https://www.dropbox.com/developers/apps/create")
-	fmt.Println("Choose 'Dropbox Api App' and then choose the appropriate permissions\n and access restriction you want to apply.")
-	fmt.Println("Enter any app name you want.")
-	fmt.Println("After you sucessfully created your own app. Go to the app configuration page.")
-	fmt.Println("Please type the app key and secret key below.")
-	for {
-		fmt.Print("App Key:")
-		fmt.Scanln(&app_key)
-		fmt.Print("App Secret:")
-		fmt.Scanln(&secret_key)
-		fmt.Printf("The App Key is %v and App Secret Key is %v. It is Ok?(y/n)\n", app_key, secret_key)
-		var answer string
-		fmt.Scanf("%c", &answer)
-		if strings.ToLower(answer) == "y" {
-			break
-		}
-	}
-	authorize_url := "https://www.dropbox.com/1/oauth2/authorize"
-	response_type := "code"
-	authorize_url = authorize_url + "?" + "response_type=" + response_type + "&client_id=" + app_key
-	fmt.Printf("Now open the following URL in your browser: %s\n", authorize_url)
-	var auth_code string
-	for {
-		fmt.Println("Please type the given authorization code")
-		fmt.Scanf("%s", &auth_code)
-		fmt.Printf("The Authoirzation code is %v. Is it Ok?(y/n)", auth_code)
-		var answer string
-		fmt.Scanf("%c", &answer)
-		if strings.ToLower(answer) == "y" {
-			break
+// kLoginPort is where login listens for the redirect by default,
+// http://127.0.0.1:53682/callback must be a redirect uri of the app.
+const kLoginPort = 53682
+
+// login authorizes gdbox as the app app_key with PKCE and sets the
+// token of dbox. The code comes back through a redirect to 127.0.0.1,
+// or is pasted when manual is set, for machines without a browser.
+func login(ctx context.Context, dbox *lib.Dropbox, app_key string, port int, manual bool) error {
+	pkce, err := lib.NewPKCE()
+	if err != nil {
+		return err
+	}
+	state, err := lib.NewState()
+	if err != nil {
+		return err
+	}
+	if manual {
+		fmt.Println("Open the following URL in a browser, allow access and paste the code:")
+		fmt.Println(lib.AuthorizeURL(app_key, "", "", pkce))
+		fmt.Print("Code: ")
+		var code string
+		fmt.Scanln(&code)
+		if code = strings.TrimSpace(code); code == "" {
+			return errors.New("no code given")
 		}
+		return dbox.ExchangeCodeContext(ctx, app_key, code, "", pkce.Verifier)
 	}
-	token, _ := Oath2Athorize(app_key, secret_key, auth_code)
-	return token
-}
-
-// Rename this function and change parameter
-// name: such as subdirectory
-//so we do not neet to input file_limit
-func GetSubfileNames(path string, file_limit int) []string {
-	var files []string
-	parent, err := os.Open(path)
-	defer parent.Close()
+	redirect, err := lib.ListenLoopback(port, state)
 	if err != nil {
-		return files
+		return fmt.Errorf("%v, use -port or -manual", err)
 	}
-	if stat, _ := parent.Stat(); !stat.IsDir() {
-		return []string{path}
+	defer redirect.Close()
+	authorize_url := lib.AuthorizeURL(app_key, redirect.URL, state, pkce)
+	fmt.Println("Open the following URL in a browser and allow access:")
+	fmt.Println(authorize_url)
+	openBrowser(authorize_url)
+	code, err := redirect.Wait(ctx)
+	if err != nil {
+		return err
 	}
-	queue, _ := parent.Readdirnames(0)
-	path = strings.TrimSuffix(path, "/")
-	for idx, name := range queue {
-		queue[idx] = path + "/" + name
+	return dbox.ExchangeCodeContext(ctx, app_key, code, redirect.URL, pkce.Verifier)
+}
+
+// logout revokes the token of dbox, unless local is set, then removes
+// the tokens of the profile from the config or its credential helper,
+// and its upload journals, listing cache and sync state. It prints what
+// it cleared.
+func logout(ctx context.Context, dbox *lib.Dropbox, local bool) error {
+	switch {
+	case dbox.Token.AccessToken == "":
+		fmt.Println("Not logged in, no token to revoke")
+	case local:
+		fmt.Println("Token not revoked, it stays valid until it expires")
+	default:
+		err := dbox.RevokeContext(ctx)
+		if errors.Is(err, lib.ErrUnauthorized) {
+			fmt.Println("Token was already revoked or expired")
+		} else if err != nil {
+			return fmt.Errorf("revoking the token: %v, use -local to only remove it here", err)
+		} else {
+			fmt.Println("Revoked the token")
+		}
 	}
-	//    queue = append(queue, path)
-	for len(queue) > 0 {
-		head := queue[0]
-		if len(files) > file_limit {
-			return files
+	kConfig.setToken(lib.Token{})
+	err := updateConfig(kConfigPath, func(c *Config) error {
+		section := c.section(kProfile)
+		if helper := c.credentialHelper(section); helper != "" {
+			if _, err := runCredentialHelper(helper, "erase", kProfile, ""); err != nil {
+				return err
+			}
+			fmt.Println("Erased the tokens from the credential helper")
 		}
-		child, err := os.Open(head)
-		if err != nil {
-			queue = queue[1:]
+		if section.AccessToken != "" || section.RefreshToken != "" || section.SealedTokens != nil {
+			fmt.Println("Removed the tokens from " + kConfigPath)
+		}
+		section.setToken(lib.Token{})
+		section.SealedTokens = nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	dir := kConfig.stateDir()
+	if dir == "" {
+		return nil
+	}
+	// Only what belongs to the account, the state folder of the default
+	// profile also holds the other profiles
+	for _, state := range []struct{ name, what string }{
+		{"uploads", "upload journals"},
+		{"cache", "listing cache"},
+		{"sync", "sync state"},
+	} {
+		state_path := filepath.Join(dir, state.name)
+		if _, err := os.Stat(state_path); err != nil {
 			continue
 		}
-		if child_info, _ := child.Stat(); child_info.IsDir() {
-			child_files, _ := child.Readdirnames(0)
-			for idx, name := range child_files {
-				child_files[idx] = head + "/" + name
-			}
-			queue = append(queue, child_files...)
-			queue = queue[1:]
-		} else {
-			files = append(files, head)
-			queue = queue[1:]
+		if err := os.RemoveAll(state_path); err != nil {
+			return err
 		}
-		child.Close()
+		fmt.Println("Removed the " + state.what + " in " + state_path)
+	}
+	return nil
+}
+
+// openBrowser tries to open url in the default browser, the url is
+// printed anyway. Tests replace it to play the user.
+var openBrowser = startBrowser
+
+func startBrowser(url string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			return
+		}
+		cmd = exec.Command("xdg-open", url)
+	}
+	if cmd.Start() == nil {
+		go cmd.Wait()
 	}
-	return files
 }
@@ -1,17 +1,311 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/isyangban/gdbox/lib"
+	"github.com/isyangban/gdbox/lib/dboxtest"
 )
 
-func Test_bfsFolders(t *testing.T) {
-	//want := []string{"contacts.txt", "gdbox.go", "json.go", "maps.go", "max.go", "numbers.go", "slice.go", "strings.go"}
-	result := bfsFolders("/data/service/share/", 1000)
-	t.Log("Result of traversing ../:", result)
+// newTestServer points kConfig at a fake server for the rest of the test.
+func newTestServer(t *testing.T) *dboxtest.Server {
+	srv := dboxtest.NewServer()
+	t.Cleanup(srv.Close)
+	old := kConfig
+	kConfig = &Config{AccessToken: "token", ApiHost: srv.URL, ContentHost: srv.URL, NotifyHost: srv.URL}
+	t.Cleanup(func() { kConfig = old })
+	return srv
+}
+
+// run runs a command line with stdout discarded and stdin set to input.
+func run(t *testing.T, input string, args ...string) {
+	t.Helper()
+	flags := flag.NewFlagSet("gdbox", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	stdin, stdout := os.Stdin, os.Stdout
+	defer func() { os.Stdin, os.Stdout = stdin, stdout }()
+	os.Stdout, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	defer os.Stdout.Close()
+	r, w, _ := os.Pipe()
+	defer r.Close()
+	w.WriteString(input)
+	w.Close()
+	os.Stdin = r
+	handler(context.Background(), flags)
+}
+
+func TestDownloadCommand(t *testing.T) {
+	srv := newTestServer(t)
+	srv.PutFile("/docs/a.txt", []byte("a"))
+	srv.PutFile("/docs/b.txt", []byte("b"))
+	srv.PutFile("/docs/sub/c.txt", []byte("c"))
+	srv.PageLimit = 1
+	dir := t.TempDir()
+
+	run(t, "", "download", "-j", "2", "/docs", dir)
+	run(t, "", "download", "/docs/a.txt", filepath.Join(dir, "single.txt"))
+	for name, want := range map[string]string{"docs/a.txt": "a", "docs/b.txt": "b", "docs/sub/c.txt": "c", "single.txt": "a"} {
+		if data, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v", name, data, err)
+		}
+	}
+}
+
+func TestUploadCommand(t *testing.T) {
+	srv := newTestServer(t)
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.log"), []byte("b"), 0644)
+
+	run(t, "", "upload", "-exclude", "*.log", dir, "/up")
+	if data, ok := srv.File("/up/a.txt"); !ok || string(data) != "a" {
+		t.Errorf("/up/a.txt = %q, %v", data, ok)
+	}
+	if srv.Exists("/up/b.log") {
+		t.Error("excluded /up/b.log was uploaded")
+	}
+}
+
+func TestFileCommands(t *testing.T) {
+	srv := newTestServer(t)
+	srv.PutFile("/a.txt", []byte("a"))
+
+	run(t, "", "mkdir", "/dir")
+	if !srv.IsDir("/dir") {
+		t.Fatal("mkdir did not create /dir")
+	}
+	run(t, "", "cp", "/a.txt", "/dir/b.txt")
+	run(t, "", "mv", "/a.txt", "/dir/c.txt")
+	if !srv.Exists("/dir/b.txt") || !srv.Exists("/dir/c.txt") || srv.Exists("/a.txt") {
+		t.Fatalf("after cp and mv: %v", srv.Paths())
+	}
+	run(t, "n\n", "rm", "/dir/b.txt")
+	if !srv.Exists("/dir/b.txt") {
+		t.Fatal("rm deleted a file without confirmation")
+	}
+	run(t, "y\n", "rm", "/dir/b.txt")
+	if srv.Exists("/dir/b.txt") {
+		t.Fatal("rm did not delete /dir/b.txt")
+	}
+	// ls, find and du only print, they must not fail on a fake server
+	run(t, "", "ls")
+	run(t, "", "ls", "/dir")
+	run(t, "", "find", "/", "c.txt")
+	run(t, "", "find", "-exclude", "dir/", "/", "*.txt")
+	run(t, "", "du")
+	run(t, "", "du", "/dir/c.txt")
+}
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		expression string
+		name       string
+		want       bool
+	}{
+		{"*.txt", "Notes.TXT", true},
+		{"*.txt", "notes.txt.bak", false},
+		{"report", "Q1 Report.pdf", true},
+		{"q1 report", "Q1 Report.pdf", true},
+		{"q2 report", "Q1 Report.pdf", false},
+		{"", "a.txt", false},
+	}
+	for _, test := range tests {
+		if got := matchName(test.expression, test.name); got != test.want {
+			t.Errorf("matchName(%q, %q) = %v", test.expression, test.name, got)
+		}
+	}
 }
 
-func TestDownload(t *testing.T) {
-	files := []string{"contacts.txt"}
-	folders := []string{"temp", "영재원"}
+func TestMirrorCommand(t *testing.T) {
+	srv := newTestServer(t)
+	srv.PutFile("/m/extra.txt", []byte("extra"))
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+
+	run(t, "", "mirror", "--dry-run", "up", dir, "/m")
+	if !srv.Exists("/m/extra.txt") || srv.Exists("/m/a.txt") {
+		t.Fatalf("dry run changed the destination: %v", srv.Paths())
+	}
+	run(t, "", "mirror", "up", dir, "/m")
+	if srv.Exists("/m/extra.txt") || !srv.Exists("/m/a.txt") {
+		t.Fatalf("after the mirror: %v", srv.Paths())
+	}
+}
+
+func TestLoginCommand(t *testing.T) {
+	srv := newTestServer(t)
+	kConfig.AccessToken = ""
+	old := openBrowser
+	defer func() { openBrowser = old }()
+	// Allow access as the user would, on the authorize page
+	openBrowser = func(authorize_url string) {
+		u, err := url.Parse(authorize_url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := u.Query()
+		redirect_uri := query.Get("redirect_uri")
+		code := srv.Authorize(query.Get("client_id"), query.Get("code_challenge"), redirect_uri)
+		resp, err := http.Get(redirect_uri + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	run(t, "", "login", "-app-key", "app", "-port", "0")
+	if kConfig.AccessToken != "token-1" || kConfig.AppKey != "app" {
+		t.Errorf("after login: token %q, app key %q", kConfig.AccessToken, kConfig.AppKey)
+	}
+}
+
+func TestCheckIgnoreWithoutLogin(t *testing.T) {
+	dir := t.TempDir()
+	// Neither a config file nor a login is needed, nor a passphrase
+	if _, err := loadConfig(filepath.Join(dir, "missing.conf"), "", "check-ignore"); err != nil {
+		t.Errorf("without a config file: %v", err)
+	}
+	config_path := filepath.Join(dir, "gdbox.conf")
+	config := &Config{Ignore: []string{"*.log"}, Encryption: &tokenEncryption{KDF: "scrypt"}, SealedTokens: []byte("sealed")}
+	if err := config.SaveFile(config_path); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(config_path, "", "check-ignore")
+	if err != nil {
+		t.Fatalf("with encrypted tokens: %v", err)
+	}
+	if len(c.Ignore) != 1 {
+		t.Errorf("ignore = %q", c.Ignore)
+	}
+}
+
+func TestLogoutCommand(t *testing.T) {
+	srv := newTestServer(t)
+	dir := t.TempDir()
+	kConfigPath, kStateDir = filepath.Join(dir, "gdbox.conf"), dir
+	defer func() { kConfigPath, kStateDir = "", "" }()
+	config := &Config{AccessToken: "token", RefreshToken: "refresh", Profiles: map[string]*Config{"work": {AccessToken: "work"}}}
+	if err := config.SaveFile(kConfigPath); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"uploads", "cache", "sync", "profiles/work/cache"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run(t, "", "logout")
+	if n := srv.Requests("auth/token/revoke"); n != 1 {
+		t.Errorf("%d revoke requests", n)
+	}
+	var saved Config
+	if err := saved.LoadFile(kConfigPath); err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken != "" || saved.RefreshToken != "" || kConfig.AccessToken != "" {
+		t.Errorf("tokens left: config %+v, kConfig %q", saved, kConfig.AccessToken)
+	}
+	if saved.Profiles["work"].AccessToken != "work" {
+		t.Error("logout removed the token of another profile")
+	}
+	for _, name := range []string{"uploads", "cache", "sync"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s left: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "profiles/work/cache")); err != nil {
+		t.Error("logout removed the state of another profile:", err)
+	}
+
+	// Logged out already, nothing is revoked
+	run(t, "", "logout")
+	if n := srv.Requests("auth/token/revoke"); n != 1 {
+		t.Errorf("%d revoke requests after logging out twice", n)
+	}
+}
+
+func TestConfigStore(t *testing.T) {
+	srv := newTestServer(t)
+	srv.RotateRefreshTokens = true
+	pkce, _ := lib.NewPKCE()
+	dbox := kConfig.NewDropbox()
+	if err := dbox.ExchangeCode("app", srv.Authorize("app", pkce.Challenge, ""), "", pkce.Verifier); err != nil {
+		t.Fatal(err)
+	}
+	config_path := filepath.Join(t.TempDir(), "gdbox.conf")
+	config := *kConfig
+	config.AppKey = "app"
+	config.setToken(dbox.Token)
+	if err := config.SaveFile(config_path); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(config_path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("config file mode %v, %v", info.Mode(), err)
+	}
+	kConfigPath = config_path
+	defer func() { kConfigPath = "" }()
+
+	// Two processes with the same config, the second takes the token the
+	// first refreshed, its own refresh token was rotated away
+	var clients []*lib.Dropbox
+	for i := 0; i < 2; i++ {
+		var c Config
+		if err := c.LoadFile(config_path); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c.NewDropbox())
+	}
+	srv.ExpireTokens()
+	for _, client := range clients {
+		if _, err := client.GetAccount(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var saved Config
+	saved.LoadFile(config_path)
+	for _, token := range []lib.Token{clients[1].Token, *saved.ToToken()} {
+		if want := clients[0].Token; token.AccessToken != want.AccessToken || token.RefreshToken != want.RefreshToken {
+			t.Errorf("token %q %q, want %q %q", token.AccessToken, token.RefreshToken, want.AccessToken, want.RefreshToken)
+		}
+	}
+	if n := srv.Requests("oauth2/token"); n != 2 {
+		t.Errorf("%d token requests, want a login and one refresh", n)
+	}
+}
 
+func TestLockFile(t *testing.T) {
+	lock_path := filepath.Join(t.TempDir(), "lock")
+	// A lock file left by a gdbox that died is not held
+	ioutil.WriteFile(lock_path, []byte("123\n"), 0600)
+	unlock, err := lockFile(lock_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan bool)
+	go func() {
+		unlock, err := lockFile(lock_path)
+		if err == nil {
+			unlock()
+		}
+		locked <- err == nil
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock taken twice")
+	case <-time.After(200 * time.Millisecond):
+	}
+	unlock()
+	if !<-locked {
+		t.Error("lock not taken after it was released")
+	}
 }
@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// kCacheSize is the default bound of a MetadataCache, and
+// kCacheEntrySize a guess of the size of a cached entry, to stop
+// collecting a listing that will not fit.
+const (
+	kCacheSize      = 64 << 20
+	kCacheEntrySize = 512
+)
+
+// MetadataCache keeps folder listings in Dir between runs, one json file
+// per folder with the cursor it was listed at. A cached listing is
+// brought up to date with the changes since its cursor instead of being
+// listed again. The least recently used listings are evicted when the
+// files add up to more than MaxBytes. A nil cache keeps nothing.
+type MetadataCache struct {
+	Dir      string
+	MaxBytes int64 // kCacheSize when 0
+}
+
+// cachedListing is a listing of a folder, or of its subtree when
+// recursive.
+type cachedListing struct {
+	Path      string     `json:"path"`
+	Recursive bool       `json:"recursive"`
+	Cursor    string     `json:"cursor"`
+	Entries   []Metadata `json:"entries"`
+}
+
+func (c *MetadataCache) maxBytes() int64 {
+	if c.MaxBytes > 0 {
+		return c.MaxBytes
+	}
+	return kCacheSize
+}
+
+// fits reports whether a listing of n entries is worth collecting.
+func (c *MetadataCache) fits(n int) bool {
+	return c != nil && int64(n)*kCacheEntrySize <= c.maxBytes()
+}
+
+func (c *MetadataCache) file(folder string, recursive bool) string {
+	key := strings.ToLower(apiPath(folder))
+	if recursive {
+		key += "\x00recursive"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// load returns the cached listing of folder.
+func (c *MetadataCache) load(folder string, recursive bool) (*cachedListing, bool) {
+	if c == nil {
+		return nil, false
+	}
+	file := c.file(folder, recursive)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, false
+	}
+	listing := new(cachedListing)
+	if json.Unmarshal(data, listing) != nil || listing.Cursor == "" ||
+		!strings.EqualFold(listing.Path, apiPath(folder)) || listing.Recursive != recursive {
+		return nil, false
+	}
+	// The mtime orders the files for eviction
+	now := time.Now()
+	os.Chtimes(file, now, now)
+	return listing, true
+}
+
+// save caches a listing and evicts old ones if the cache is too large.
+// Listings larger than the whole cache are not kept.
+func (c *MetadataCache) save(listing *cachedListing) error {
+	if c == nil {
+		return nil
+	}
+	data, err := json.Marshal(listing)
+	if err != nil {
+		return err
+	}
+	file := c.file(listing.Path, listing.Recursive)
+	if int64(len(data)) > c.maxBytes() {
+		os.Remove(file)
+		return nil
+	}
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(c.Dir, ".cache-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if close_err := tmp.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return c.evict()
+}
+
+// evict removes the least recently used listings until the cache fits
+// in MaxBytes.
+func (c *MetadataCache) evict() error {
+	infos, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, info := range infos {
+		total += info.Size()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, info := range infos {
+		if total <= c.maxBytes() {
+			break
+		}
+		if strings.HasSuffix(info.Name(), ".json") && os.Remove(filepath.Join(c.Dir, info.Name())) == nil {
+			total -= info.Size()
+		}
+	}
+	return nil
+}
+
+// Clear removes every cached listing.
+func (c *MetadataCache) Clear() error {
+	if c == nil {
+		return nil
+	}
+	return os.RemoveAll(c.Dir)
+}
+
+// update brings a cached listing up to date with the changes since its
+// cursor, and reports whether there were any. It fails when the cursor
+// is no longer valid. The entries of a changed listing are sorted by
+// path, so a folder still comes before its contents.
+func (dbox *Dropbox) update(ctx context.Context, listing *cachedListing) (bool, error) {
+	index := make(map[string]int, len(listing.Entries))
+	for i, entry := range listing.Entries {
+		index[entry.PathLower] = i
+	}
+	changed := false
+	for {
+		var changes listFolderResult
+		if err := dbox.rpc(ctx, "files/list_folder/continue", map[string]interface{}{"cursor": listing.Cursor}, &changes); err != nil {
+			return false, err
+		}
+		for _, entry := range changes.Entries {
+			i, ok := index[entry.PathLower]
+			switch {
+			case entry.Tag == "deleted" && ok:
+				listing.Entries[i].Tag = "deleted"
+			case entry.Tag == "deleted":
+			case ok:
+				listing.Entries[i] = entry
+			default:
+				index[entry.PathLower] = len(listing.Entries)
+				listing.Entries = append(listing.Entries, entry)
+			}
+			// A deleted folder takes its contents with it
+			if entry.Tag == "deleted" && listing.Recursive {
+				for lower, j := range index {
+					if strings.HasPrefix(lower, entry.PathLower+"/") {
+						listing.Entries[j].Tag = "deleted"
+					}
+				}
+			}
+		}
+		changed = changed || len(changes.Entries) > 0
+		listing.Cursor = changes.Cursor
+		if !changes.HasMore {
+			break
+		}
+	}
+	if changed {
+		entries := listing.Entries[:0]
+		for _, entry := range listing.Entries {
+			if entry.Tag != "deleted" {
+				entries = append(entries, entry)
+			}
+		}
+		listing.Entries = entries
+		sort.Slice(entries, func(i, j int) bool { return entries[i].PathLower < entries[j].PathLower })
+	}
+	return changed, nil
+}
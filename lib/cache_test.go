@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadataCache(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/c/a.txt", []byte("a"))
+	srv.PutFile("/c/b.txt", []byte("b"))
+	srv.PutFile("/c/sub/c.txt", []byte("c"))
+	cache := &MetadataCache{Dir: t.TempDir()}
+	dbox.Cache = cache
+	if _, err := dbox.GetMetaData("/c"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another run gets the listing from the cache and its changes
+	srv.PutFile("/c/a.txt", []byte("edited"))
+	srv.PutFile("/c/d.txt", []byte("d"))
+	if _, err := dbox.Delete("/c/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	_, dbox = newTestDropbox(t)
+	dbox.ApiHost, dbox.Cache = srv.URL, cache
+	listings := srv.Requests("files/list_folder")
+	metadata, err := dbox.GetMetaData("/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Requests("files/list_folder") != listings {
+		t.Error("cached folder was listed again")
+	}
+	var names []string
+	for _, entry := range metadata.Contents {
+		names = append(names, entry.Name)
+		if entry.Name == "a.txt" && entry.Bytes != 6 {
+			t.Errorf("a.txt has size %d after the edit", entry.Bytes)
+		}
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != "a.txt d.txt sub" {
+		t.Errorf("cached contents = %v", names)
+	}
+
+	// A cursor the server no longer knows is listed again
+	listing, _ := cache.load("/c", false)
+	listing.Cursor = "expired"
+	cache.save(listing)
+	_, dbox = newTestDropbox(t)
+	dbox.ApiHost, dbox.Cache = srv.URL, cache
+	if metadata, err := dbox.GetMetaData("/c"); err != nil || len(metadata.Contents) != 3 {
+		t.Errorf("GetMetaData with an expired cursor = %d entries, %v", len(metadata.Contents), err)
+	}
+	if srv.Requests("files/list_folder") != listings+1 {
+		t.Error("folder with an expired cursor was not listed again")
+	}
+
+	// Walks are cached too, and see the changes
+	walk := func() []string {
+		var paths []string
+		if err := dbox.Walk("/c", func(entry Metadata) error {
+			paths = append(paths, entry.Path)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return paths
+	}
+	walk()
+	dbox.Delete("/c/sub")
+	listings = srv.Requests("files/list_folder")
+	if paths := walk(); strings.Join(paths, " ") != "/c/a.txt /c/d.txt" {
+		t.Errorf("cached Walk = %v", paths)
+	}
+	if srv.Requests("files/list_folder") != listings {
+		t.Error("cached tree was listed again")
+	}
+	dbox.Delete("/c")
+	if err := dbox.Walk("/c", func(Metadata) error { return nil }); err == nil {
+		t.Error("cached Walk of a deleted folder did not fail")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	cache := &MetadataCache{Dir: t.TempDir(), MaxBytes: 1000}
+	entries := make([]Metadata, 2)
+	for i, name := range []string{"/a", "/b", "/c"} {
+		cache.save(&cachedListing{Path: name, Cursor: "cursor", Entries: entries})
+		// Used an hour apart
+		old := time.Now().Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(cache.file(name, false), old, old)
+	}
+	files, _ := ioutil.ReadDir(cache.Dir)
+	var total int64
+	for _, file := range files {
+		total += file.Size()
+	}
+	if total > cache.MaxBytes {
+		t.Errorf("cache holds %d bytes, over %d", total, cache.MaxBytes)
+	}
+	if _, ok := cache.load("/c", false); !ok {
+		t.Error("newest listing was evicted")
+	}
+	if _, ok := cache.load("/a", false); ok {
+		t.Error("oldest listing was kept")
+	}
+
+	// Too large for the cache at all
+	cache.save(&cachedListing{Path: "/d", Cursor: "cursor", Entries: make([]Metadata, 100)})
+	if _, ok := cache.load("/d", false); ok {
+		t.Error("listing larger than the cache was kept")
+	}
+	cache.Clear()
+	if _, ok := cache.load("/c", false); ok {
+		t.Error("Clear left listings")
+	}
+}
@@ -1,38 +1,100 @@
 package lib
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/url"
-	"os"
-	"path/filepath"
-	"strconv"
+	"path"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
 )
 
 //TODO: Set Some basic consttants
 type dboxConst struct {
-	MaxFileLimit          int
-	DirectUploadSizeLimit int
+	DirectUploadSizeLimit int64
 	MaxTryLimit           int
+	// Chunks of concurrent upload sessions must be a multiple of this
+	ChunkAlign int64
+	// Most entries asked for in a page of a folder listing
+	ListPageLimit int
 }
 
 var kDboxConst = dboxConst{
-	MaxFileLimit:          10000,
 	DirectUploadSizeLimit: 15 * 1000 * 1000,
 	MaxTryLimit:           5,
+	ChunkAlign:            4 * 1024 * 1024,
+	ListPageLimit:         2000,
 }
 
+// Default base urls of the api servers
+const (
+	kApiHost     = "https://api.dropboxapi.com"
+	kContentHost = "https://content.dropboxapi.com"
+	kNotifyHost  = "https://notify.dropboxapi.com"
+)
+
 //Todo: change Metadata, Client, Addauthheader to private variable/Functions
 type Dropbox struct {
 	Account  Account
 	Token    Token
 	Metadata map[string]Metadata
 	Client   *http.Client
+
+	// Base urls for rpc, content and notify (longpoll) endpoints.
+	// They default to the public api servers and can point to a
+	// gateway or a fake server instead.
+	ApiHost     string
+	ContentHost string
+	NotifyHost  string
+
+	// MaxTries is how many times a request is sent before giving up,
+	// see do for which failures are retried.
+	MaxTries int
+	// Journal records chunked uploads so they can be resumed with
+	// UploadResume, nil disables it.
+	Journal *UploadJournal
+	// Workers is how many files Upload sends at once. Report, if set,
+	// is called for every file in order, see RunTransfers.
+	Workers int
+	Report  func(TransferResult)
+	// ChunkSize is the size of the chunks of files too large for a
+	// direct upload, DirectUploadSizeLimit when 0. With ChunkWorkers
+	// above 1 the chunks of a file are sent in parallel through a
+	// concurrent upload session.
+	ChunkSize    int64
+	ChunkWorkers int
+	// Policy resolves conflicts of Upload and Sync, "" is overwrite for
+	// Upload and rename for Sync.
+	Policy ConflictPolicy
+	// ExpectedRev is the rev of the remote file an Upload with
+	// PolicyUpdate replaces, as the caller last saw it. Without it the
+	// upload only creates the file. Folders can not be uploaded with it.
+	ExpectedRev string
+	// ListWorkers is how many folders Walk lists at once, 1 walks a
+	// tree with a single recursive listing.
+	ListWorkers int
+	// Cache keeps folder listings on disk between runs, nil keeps them
+	// in Metadata for the life of the Dropbox only.
+	Cache *MetadataCache
+	// Filter leaves files out of the folders transferred by Upload,
+	// Sync and Mirror, nil transfers everything.
+	Filter *Filter
+	// AppKey is the app a token with a RefreshToken was issued to. Such
+	// tokens are refreshed before they expire, and saved to Store if
+	// it is set.
+	AppKey string
+	Store  TokenStore
+
+	mu       sync.Mutex // guards Metadata
+	token_mu sync.Mutex // guards Token once requests are sent
+	stats *RetryStats
+	sleep func(ctx context.Context, d time.Duration) error
 }
 
 func NewDropbox(token Token) *Dropbox {
@@ -40,31 +102,152 @@ func NewDropbox(token Token) *Dropbox {
 	dbox.Token = token
 	dbox.Client = &http.Client{}
 	dbox.Metadata = make(map[string]Metadata)
+	dbox.ApiHost = kApiHost
+	dbox.ContentHost = kContentHost
+	dbox.NotifyHost = kNotifyHost
+	dbox.MaxTries = kDboxConst.MaxTryLimit
+	dbox.Workers = 1
+	dbox.ChunkWorkers = 1
+	dbox.ListWorkers = 1
+	dbox.stats = &RetryStats{}
+	dbox.sleep = sleepContext
 	return dbox
 }
 
+// endpointURL joins a base url and an endpoint such as "2/files/upload".
+func endpointURL(host string, endpoint string) string {
+	return strings.TrimSuffix(host, "/") + "/" + endpoint
+}
+
 // Delete this method and change to sperate function
 func (dbox *Dropbox) AddAuthHeader(r *http.Request) {
 	//var auth_header = "Bearer <YOUR_ACCESS_TOKEN_HERE>"
-	r.Header.Add("Authorization", "Bearer "+dbox.Token.AccessToken)
+	r.Header.Add("Authorization", "Bearer "+dbox.token().AccessToken)
+}
+
+// apiPath converts a user supplied path into the form the api expects.
+// The root folder is the empty string and paths never end with a slash.
+func apiPath(p string) string {
+	if p == "" || p == "/" || p == "." {
+		return ""
+	}
+	if strings.HasPrefix(p, "id:") || strings.HasPrefix(p, "rev:") {
+		return p
+	}
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return ""
+	}
+	return p
+}
+
+// headerArg encodes arg for the Dropbox-API-Arg header, which must be
+// plain ascii so every other character is escaped.
+func headerArg(arg interface{}) (string, error) {
+	b, err := json.Marshal(arg)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	for _, r := range string(b) {
+		if r < 0x7f {
+			buf.WriteRune(r)
+			continue
+		}
+		for _, u := range utf16.Encode([]rune{r}) {
+			fmt.Fprintf(&buf, "\\u%04x", u)
+		}
+	}
+	return buf.String(), nil
+}
+
+// rpc calls an rpc style endpoint, arg and result are encoded as json.
+func (dbox *Dropbox) rpc(ctx context.Context, endpoint string, arg interface{}, result interface{}) error {
+	body, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+	resp, err := dbox.do(ctx, endpoint, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", endpointURL(dbox.ApiHost, "2/"+endpoint), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// content calls a content style endpoint, arg is sent in the
+// Dropbox-API-Arg header. body is rewound when the request is retried.
+// The caller must close the response body.
+func (dbox *Dropbox) content(ctx context.Context, endpoint string, arg interface{}, body io.ReadSeeker) (*http.Response, error) {
+	api_arg, err := headerArg(arg)
+	if err != nil {
+		return nil, err
+	}
+	return dbox.do(ctx, endpoint, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", endpointURL(dbox.ContentHost, "2/"+endpoint), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Dropbox-API-Arg", api_arg)
+		if body != nil {
+			size, err := body.Seek(0, io.SeekEnd)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			// NopCloser so the client does not close files between tries
+			req.Body = ioutil.NopCloser(body)
+			req.ContentLength = size
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		return req, nil
+	})
 }
 
 type Token struct {
 	AccessToken string `json:"access_token"`
 	TokenType   string `json:"token_type"`
+	AccountId   string `json:"account_id"`
 	Uid         string `json:"uid"`
+	// Short lived access tokens come with a refresh token to get new ones,
+	// and last ExpiresIn seconds, until Expiry.
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	ExpiresIn    int       `json:"expires_in,omitempty"`
+	Expiry       time.Time `json:"-"`
 }
 
 func NewToken(token_json []byte) *Token {
 	var token Token
 	json.Unmarshal(token_json, &token)
+	if token.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
 	return &token
 }
 
+type AccountName struct {
+	DisplayName string `json:"display_name"`
+	GivenName   string `json:"given_name"`
+	Surname     string `json:"surname"`
+}
+
 type Account struct {
-	Display_name string `json:"display_name"`
-	Uid          int    `json:"uid"`
-	Locale       string `json:"locale"`
+	AccountId string      `json:"account_id"`
+	Name      AccountName `json:"name"`
+	Email     string      `json:"email"`
+	Locale    string      `json:"locale"`
 }
 
 func NewAccount(account_json []byte) *Account {
@@ -77,49 +260,44 @@ func NewAccount(account_json []byte) *Account {
 }
 
 func (dbox *Dropbox) GetAccount() (Account, error) {
-	req, _ := http.NewRequest("GET", "https://api.dropbox.com/1/account/info", nil)
-	dbox.AddAuthHeader(req)
-	resp, _ := dbox.Client.Do(req)
-	defer resp.Body.Close()
-
-	switch resp.StatusCode {
-	case 200:
-		body, _ := ioutil.ReadAll(resp.Body)
-		dbox.Account = *NewAccount(body)
-		return dbox.Account, nil
-	default:
-		return Account{}, errors.New(resp.Status)
-	}
+	return dbox.GetAccountContext(context.Background())
 }
 
-func (dbox *Dropbox) Oath2Athorize(client_id, client_secret, auth_code string) error {
-	parm := url.Values{"code": {auth_code}, "grant_type": {"authorization_code"}, "client_id": {client_id}, "client_secret": {client_secret}}
-	resp, err := http.PostForm("https://api.dropbox.com/1/oauth2/token", parm)
-	if err != nil {
-		return errors.New("Error in recieving token\n")
-	}
-	defer resp.Body.Close()
-	switch resp.StatusCode {
-	case 200:
-		body, _ := ioutil.ReadAll(resp.Body)
-		dbox.Token = *NewToken(body)
-		return nil
-	default:
-		return errors.New(resp.Status)
+// GetAccountContext is GetAccount with a context.
+func (dbox *Dropbox) GetAccountContext(ctx context.Context) (Account, error) {
+	var account Account
+	if err := dbox.rpc(ctx, "users/get_current_account", nil, &account); err != nil {
+		return Account{}, err
 	}
+	dbox.Account = account
+	return dbox.Account, nil
 }
 
+// Metadata of a file or folder. Contents and Cursor are only filled in
+// for folders fetched with GetMetaData.
 type Metadata struct {
-	Size     string     `json:"size"`
-	Rev      string     `json:"rev"`
-	Bytes    int        `json:"bytes"`
-	Modified string     `json:"modified"`
-	Path     string     `json:"path"`
-	IsDir    bool       `json:"is_dir"`
-	Root     string     `json:"root"`
-	Revision int        `json:"revision"`
-	Hash     string     `json:"hash"`
-	Contents []Metadata `json:"contents"`
+	Tag            string     `json:".tag"`
+	Name           string     `json:"name"`
+	Id             string     `json:"id"`
+	Path           string     `json:"path_display"`
+	PathLower      string     `json:"path_lower"`
+	Rev            string     `json:"rev"`
+	Bytes          int64      `json:"size"`
+	ClientModified string     `json:"client_modified"`
+	Modified       string     `json:"server_modified"`
+	ContentHash    string     `json:"content_hash"`
+	IsDir          bool       `json:"-"`
+	Cursor         string     `json:"cursor,omitempty"`
+	Contents       []Metadata `json:"contents,omitempty"`
+}
+
+func (m *Metadata) UnmarshalJSON(data []byte) error {
+	type metadata Metadata
+	if err := json.Unmarshal(data, (*metadata)(m)); err != nil {
+		return err
+	}
+	m.IsDir = m.Tag == "folder"
+	return nil
 }
 
 func NewMetadata(metadata_json []byte) *Metadata {
@@ -128,28 +306,6 @@ func NewMetadata(metadata_json []byte) *Metadata {
 	return &metadata
 }
 
-//Change name to File name list
-//Used for getting all the file names in a folder
-func (m *Metadata) FileList(file_limit int, acc int) []string {
-	var files []string
-	if !m.IsDir {
-		acc += 1
-		if acc > file_limit {
-			return files
-		} else {
-			files = append(files, m.Path)
-			return files
-		}
-	} else {
-		for _, c := range m.Contents {
-			acc += 1
-			list := c.FileList(file_limit, acc)
-			files = append(files, list...)
-		}
-		return files
-	}
-}
-
 func (m *Metadata) FormatFileNames() string {
 	var (
 		result     string
@@ -166,262 +322,225 @@ func (m *Metadata) FormatFileNames() string {
 	return result
 }
 
+type listFolderResult struct {
+	Entries []Metadata `json:"entries"`
+	Cursor  string     `json:"cursor"`
+	HasMore bool       `json:"has_more"`
+}
+
 //TODO: Needs some exception handling when metadata is an empty struct
 func (dbox *Dropbox) GetMetaData(filepath string) (Metadata, error) {
-	parm := url.Values{"file_limit": {"100"}, "list": {"true"}, "include_deleted": {"false"}, "include_media_info": {"false"}, "include_membership": {"false"}}
-	if dbox.Metadata[filepath].Hash != "" {
-		parm.Add("hash", dbox.Metadata[filepath].Hash)
+	return dbox.GetMetaDataContext(context.Background(), filepath)
+}
+
+// GetMetaDataContext is GetMetaData with a context.
+func (dbox *Dropbox) GetMetaDataContext(ctx context.Context, filepath string) (Metadata, error) {
+	metadata := Metadata{Tag: "folder", Path: "/", IsDir: true}
+	if apiPath(filepath) != "" {
+		var err error
+		if metadata, err = dbox.StatContext(ctx, filepath); err != nil || !metadata.IsDir {
+			return metadata, err
+		}
 	}
-	url_path := strings.Replace(url.QueryEscape(filepath), "+", "%20", -1)
-	req, _ := http.NewRequest("GET", "https://api.dropbox.com/1/metadata/auto/"+url_path+"?"+parm.Encode(), nil)
-	dbox.AddAuthHeader(req)
-	resp, _ := dbox.Client.Do(req)
-	defer resp.Body.Close()
-	switch resp.StatusCode {
-	case 200:
-		body, _ := ioutil.ReadAll(resp.Body)
-		metadata := *NewMetadata(body)
-		if metadata.IsDir {
-			dbox.Metadata[filepath] = metadata
+	// An unchanged cursor is the v2 equivalent of the old 304 response,
+	// a changed one gives what changed since the listing
+	listing, ok := dbox.cachedListing(filepath)
+	changed := !ok
+	if ok {
+		var err error
+		if changed, err = dbox.update(ctx, listing); err != nil {
+			ok, changed = false, true
 		}
-		return metadata, nil
-	case 304:
-		return dbox.Metadata[filepath], nil
-	case 404:
-		return Metadata{}, errors.New("File " + filepath + " not found")
-	case 406:
-		return Metadata{}, errors.New("Too many files to return")
-	default:
-		return Metadata{}, errors.New(resp.Status)
 	}
-}
-
-func (dbox *Dropbox) Copy(from_path string, to_path string) (Metadata, error) {
-	parm := url.Values{"root": {"auto"}, "from_path": {from_path}, "to_path": {to_path}}
-	req, _ := http.NewRequest("POST", "https://api.dropbox.com/1/fileops/copy", strings.NewReader(parm.Encode()))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	dbox.AddAuthHeader(req)
-	resp, _ := dbox.Client.Do(req)
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	switch resp.StatusCode {
-	case 200:
-		return *NewMetadata(body), nil
-	default:
-		return Metadata{}, errors.New(string(body))
+	if !ok {
+		listing = &cachedListing{Path: apiPath(filepath)}
+		cursor, err := dbox.listFolder(ctx, filepath, false, func(entry Metadata) error {
+			listing.Entries = append(listing.Entries, entry)
+			return nil
+		})
+		if err != nil {
+			return Metadata{}, err
+		}
+		listing.Cursor = cursor
 	}
+	if changed {
+		dbox.Cache.save(listing)
+	}
+	metadata.Contents = listing.Entries
+	metadata.Cursor = listing.Cursor
+	dbox.mu.Lock()
+	dbox.Metadata[filepath] = metadata
+	dbox.mu.Unlock()
+	return metadata, nil
 }
 
-func (dbox *Dropbox) Move(from_path string, to_path string) (Metadata, error) {
-	parm := url.Values{"root": {"auto"}, "from_path": {from_path}, "to_path": {to_path}}
-	req, _ := http.NewRequest("POST", "https://api.dropbox.com/1/fileops/move", strings.NewReader(parm.Encode()))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	dbox.AddAuthHeader(req)
-	resp, _ := dbox.Client.Do(req)
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	switch resp.StatusCode {
-	case 200:
-		return *NewMetadata(body), nil
-	default:
-		return Metadata{}, errors.New(string(body))
+// cachedListing returns the listing of a folder from Metadata, or from
+// Cache when this process has not listed it yet.
+func (dbox *Dropbox) cachedListing(filepath string) (*cachedListing, bool) {
+	dbox.mu.Lock()
+	cached := dbox.Metadata[filepath]
+	dbox.mu.Unlock()
+	if cached.Cursor != "" {
+		// Contents may be held by a caller, changes go to a copy
+		entries := append([]Metadata(nil), cached.Contents...)
+		return &cachedListing{Path: apiPath(filepath), Cursor: cached.Cursor, Entries: entries}, true
 	}
+	return dbox.Cache.load(filepath, false)
 }
 
-func (dbox *Dropbox) CreateFolder(dir_path string) (Metadata, error) {
-	parm := url.Values{"root": {"auto"}, "path": {dir_path}}
-	req, _ := http.NewRequest("POST", "https://api.dropbox.com/1/fileops/create_folder", strings.NewReader(parm.Encode()))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	dbox.AddAuthHeader(req)
-	resp, _ := dbox.Client.Do(req)
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	switch resp.StatusCode {
-	case 200:
-		return *NewMetadata(body), nil
-	case 403:
-		return Metadata{}, errors.New("There is already a folder at the given destination")
-	default:
-		return Metadata{}, errors.New(string(body))
-	}
+// Stat returns the metadata of a file or folder, without listing the
+// contents of a folder.
+func (dbox *Dropbox) Stat(filepath string) (Metadata, error) {
+	return dbox.StatContext(context.Background(), filepath)
 }
 
-func (dbox *Dropbox) Search(folder_path string, query string) ([]Metadata, error) {
-	parm := url.Values{"file_limit": {"1000"}, "include_deleted": {"false"}}
-	for _, word := range strings.Split(query, " ") {
-		parm.Add("query", word)
+// StatContext is Stat with a context.
+func (dbox *Dropbox) StatContext(ctx context.Context, filepath string) (Metadata, error) {
+	api_path := apiPath(filepath)
+	if api_path == "" {
+		return Metadata{Tag: "folder", Path: "/", IsDir: true}, nil
 	}
-	url_path := strings.Replace(url.QueryEscape(folder_path), "+", "%20", -1)
-	req, _ := http.NewRequest("GET", "https://api.dropboxapi.com/1/search/auto/"+url_path+"?"+parm.Encode(), nil)
-	dbox.Client.Do(req)
-	metadata_list := make([]Metadata, 100) //What if unmarshal requires more size?
-	body, _ := ioutil.ReadAll(resp.Body)
-	err := json.Unmarshal(body, &metadata_list)
-	if err != nil {
-		return make([]Metadata, 0), err
+	var metadata Metadata
+	if err := dbox.rpc(ctx, "files/get_metadata", map[string]interface{}{"path": api_path}, &metadata); err != nil {
+		return Metadata{}, withPath(err, filepath)
 	}
-	return metadata_list, nil
+	return metadata, nil
 }
 
-func (dbox *Dropbox) Delete(path string) (Metadata, error) {
-	parm := url.Values{"root": {"auto"}, "path": {path}}
-	req, _ := http.NewRequest("POST", "https://api.dropbox.com/1/fileops/delete", strings.NewReader(parm.Encode()))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	//req.ParseForm()
-	dbox.AddAuthHeader(req)
-	resp, _ := dbox.Client.Do(req)
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	switch resp.StatusCode {
-	case 200:
-		return *NewMetadata(body), nil
-	default:
-		return Metadata{}, errors.New(resp.Status)
-	}
+// ListFolder calls fn for each entry of a folder, or of its whole
+// subtree when recursive, a page at a time, so folders of any size are
+// listed in full without holding them in memory. Listing stops at the
+// first error of fn, which is returned.
+func (dbox *Dropbox) ListFolder(folder string, recursive bool, fn func(Metadata) error) error {
+	return dbox.ListFolderContext(context.Background(), folder, recursive, fn)
 }
 
-//TODO: If there is no folders then make folders first
-func (dbox *Dropbox) Download(remote_path string, local_path string) error {
-	//parm := url.Values{"rev"}
-	url_path := strings.Replace(url.QueryEscape(remote_path), "+", "%20", -1)
-	req, _ := http.NewRequest("GET", "https://api-content.dropbox.com/1/files/auto/"+url_path, nil)
-	dbox.AddAuthHeader(req)
-	resp, _ := dbox.Client.Do(req)
-	defer resp.Body.Close()
-	switch resp.StatusCode {
-	case 404:
-		return errors.New("File " + remote_path + " is not found on dropbox")
-	case 200:
-		metadata_json := resp.Header.Get("x-dropbox-metadata")
-		metadata := NewMetadata([]byte(metadata_json)) // Another way arround?
-		body, _ := ioutil.ReadAll(resp.Body)
-		if len(body) != metadata.Bytes {
-			fmt.Println("Download size does not match, download: ", len(body), " expected: ", metadata.Bytes)
-		}
-		os.MkdirAll(filepath.Dir(local_path), 0755)
-		stat, err := os.Stat(local_path)
-		if err != nil {
-			if os.IsNotExist(err) {
-				err := ioutil.WriteFile(local_path, body, 0644)
-				if err != nil {
-					return err
-				}
-				return err
+// ListFolderContext is ListFolder with a context.
+func (dbox *Dropbox) ListFolderContext(ctx context.Context, folder string, recursive bool, fn func(Metadata) error) error {
+	_, err := dbox.listFolder(ctx, folder, recursive, fn)
+	return err
+}
+
+// listFolder is ListFolder returning the cursor at the end of the
+// listing, which list_folder/continue later answers with the changes.
+func (dbox *Dropbox) listFolder(ctx context.Context, folder string, recursive bool, fn func(Metadata) error) (string, error) {
+	parm := map[string]interface{}{"path": apiPath(folder), "recursive": recursive, "limit": kDboxConst.ListPageLimit}
+	var list listFolderResult
+	if err := dbox.rpc(ctx, "files/list_folder", parm, &list); err != nil {
+		return "", withPath(err, folder)
+	}
+	for {
+		for _, entry := range list.Entries {
+			if err := fn(entry); err != nil {
+				return "", err
 			}
 		}
-		if stat.IsDir() {
-			err := ioutil.WriteFile(local_path+filepath.Base(remote_path), body, 0644)
-			if err != nil {
-				return err
-			}
-		} else {
-			err := ioutil.WriteFile(local_path, body, 0644)
-			if err != nil {
-				return err
-			}
+		if !list.HasMore {
+			return list.Cursor, nil
+		}
+		cursor := list.Cursor
+		list = listFolderResult{}
+		if err := dbox.rpc(ctx, "files/list_folder/continue", map[string]interface{}{"cursor": cursor}, &list); err != nil {
+			return "", withPath(err, folder)
 		}
-		return nil
-	default:
-		return errors.New(resp.Status)
 	}
 }
 
-func (dbox *Dropbox) Upload(remote_path string, local_path string) error {
-	//"Content-Type: application/octet-stream"?
-	parm := url.Values{"overwrite": {"true"}, "autorename": {"true"}}
-	files := GetSubfileNames(local_path, 100)
-	for _, file := range files {
-		f, err := os.Open(file)
-		defer f.Close()
-		if err != nil {
-			fmt.Println("Error opening file: ", err)
-			continue
-		}
-		file_stats, err := f.Stat()
-		//Use Chunck Upload if file size is bigger than DirectUpload Size Limit
-		if file_stats.Size() > kDboxConst.DirectUploadSizeLimit {
-			sf := io.NewSectionReader(f, 0, kDboxConst.DirectUploadSizeLimit)
-			upload_id, offset, err := dbox.chunkedUpload("", sf, 0)
-			for sf.Size() > 0 {
-				upload_id, offset, _ = dbox.chunkedUpload(upload_id, sf, offset)
-				sf = io.NewSectionReader(f, offset, kDboxConst.DirectUploadSizeLimit)
-			}
-			_, err := dbox.commitChunkedUpload(remote_path, upload_id)
-			if err != nil {
-				fmt.Println(err)
-			}
-		} else { //Use Direct Upload
-			err := directUpload(remote_path, f)
-			if err != nil {
-				fmt.Println(err)
-			}
-		}
+type relocationResult struct {
+	Metadata Metadata `json:"metadata"`
+}
 
+func (dbox *Dropbox) Copy(from_path string, to_path string) (Metadata, error) {
+	return dbox.CopyContext(context.Background(), from_path, to_path)
+}
+
+// CopyContext is Copy with a context.
+func (dbox *Dropbox) CopyContext(ctx context.Context, from_path string, to_path string) (Metadata, error) {
+	parm := map[string]interface{}{"from_path": apiPath(from_path), "to_path": apiPath(to_path)}
+	var result relocationResult
+	if err := dbox.rpc(ctx, "files/copy_v2", parm, &result); err != nil {
+		return Metadata{}, relocationError(err, from_path, to_path)
 	}
-	return nil
+	return result.Metadata, nil
 }
 
-func (dbox *Dropbox) directUpload(remote_path string, fd os.File) error {
-	req, _ := http.NewRequest("PUT", "https://api-content.dropbox.com/1/files_put/auto/"+url.QueryEscape(remote_path)+"?"+parm.Encode(), f)
-	stat, _ := fd.Stat()
-	req.Header.Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
-	dbox.AddAuthHeader(req)
-	//Need to set content-type?
-	resp, _ := dbox.Client.Do(req)
-	defer resp.Body.Close()
-	switch resp.StatusCode {
-	case 200:
-		return nil
-	default:
-		return errors.New(resp.Status)
+func (dbox *Dropbox) Move(from_path string, to_path string) (Metadata, error) {
+	return dbox.MoveContext(context.Background(), from_path, to_path)
+}
+
+// MoveContext is Move with a context.
+func (dbox *Dropbox) MoveContext(ctx context.Context, from_path string, to_path string) (Metadata, error) {
+	parm := map[string]interface{}{"from_path": apiPath(from_path), "to_path": apiPath(to_path)}
+	var result relocationResult
+	if err := dbox.rpc(ctx, "files/move_v2", parm, &result); err != nil {
+		return Metadata{}, relocationError(err, from_path, to_path)
 	}
+	return result.Metadata, nil
 }
 
-type chunkedFile struct {
-	UploadId string `json:"upload_id"`
-	Offset   int64  `json:"offset"`
-	Expires  string `json:"expires"`
+func (dbox *Dropbox) CreateFolder(dir_path string) (Metadata, error) {
+	return dbox.CreateFolderContext(context.Background(), dir_path)
 }
 
-// changee io.SectionReader to io.Reader...
-func (dbox *Dropbox) chunkedUpload(upload_id string, sf *io.Reader, offset int64) (string, int64, error) {
-	parm := url.Values{}
-	if upload_id == "" {
-		parm.Add("offset", "0")
-	} else {
-		parm.Add("offset", strconv.FormatInt(offset, 10))
-		parm.Add("upload_id", upload_id)
+// CreateFolderContext is CreateFolder with a context.
+func (dbox *Dropbox) CreateFolderContext(ctx context.Context, dir_path string) (Metadata, error) {
+	parm := map[string]interface{}{"path": apiPath(dir_path), "autorename": false}
+	var result relocationResult
+	if err := dbox.rpc(ctx, "files/create_folder_v2", parm, &result); err != nil {
+		return Metadata{}, withPath(err, dir_path)
 	}
-	req, _ := http.NewRequest("PUT", "https://api-content.dropbox.com/1/chunked_upload"+"?"+parm.Encode(), sf)
-	dbox.AddAuthHeader(req)
-	resp, _ := dbox.Client.Do(req)
-	chunked_file := new(chunkedFile)
-	body, _ := ioutil.ReadAll(resp.Body)
-	err := json.Unmarshal(body, chunked_file)
-	if err != nil {
-		fmt.Println(err)
-		return "", offset, err
+	return result.Metadata, nil
+}
+
+type searchResult struct {
+	Matches []struct {
+		Metadata struct {
+			Metadata Metadata `json:"metadata"`
+		} `json:"metadata"`
+	} `json:"matches"`
+	HasMore bool   `json:"has_more"`
+	Cursor  string `json:"cursor"`
+}
+
+func (dbox *Dropbox) Search(folder_path string, query string) ([]Metadata, error) {
+	return dbox.SearchContext(context.Background(), folder_path, query)
+}
+
+// SearchContext is Search with a context.
+func (dbox *Dropbox) SearchContext(ctx context.Context, folder_path string, query string) ([]Metadata, error) {
+	parm := map[string]interface{}{
+		"query":   query,
+		"options": map[string]interface{}{"path": apiPath(folder_path), "max_results": 1000, "file_status": "active"},
+	}
+	var result searchResult
+	if err := dbox.rpc(ctx, "files/search_v2", parm, &result); err != nil {
+		return make([]Metadata, 0), withPath(err, folder_path)
+	}
+	metadata_list := make([]Metadata, 0, len(result.Matches))
+	for _, match := range result.Matches {
+		metadata_list = append(metadata_list, match.Metadata.Metadata)
 	}
-	return chunked_file.UploadId, chunked_file.Offset, nil
+	return metadata_list, nil
 }
 
-func (dbox *Dropbox) commitChunkedUpload(remote_path string, upload_id string) (Metadata, error) {
-	parm := url.Values{"upload_id": {upload_id}, "overwrite": {"true"}, "autorename": {"true"}}
-	req, _ := http.NewRequest("POST",
-		"https://content.dropboxapi.com/1/commit_chunked_upload/auto/"+url.QueryEscape(remote_path), strings.NewReader(parm.Encode()))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	dbox.AddAuthHeader(req)
-	resp, _ := dbox.Client.Do(req)
-	defer resp.Body.Close()
-	switch resp.StatusCode {
-	case 400:
-		return Metadata{}, errors.New("Invalid upload id: " + upload_id + "or chunked file does not exist")
-	case 409:
-		return Metadata{}, errors.New("Conflict with existing file")
-	case 200:
-		body, _ := ioutil.ReadAll(resp.Body)
-		return *NewMetadata(body), nil
-	default:
-		return Metadata{}, errors.New(resp.Status)
+func (dbox *Dropbox) Delete(path string) (Metadata, error) {
+	return dbox.DeleteContext(context.Background(), path)
+}
+
+// DeleteContext is Delete with a context.
+func (dbox *Dropbox) DeleteContext(ctx context.Context, path string) (Metadata, error) {
+	return dbox.deleteRev(ctx, path, "")
+}
+
+// deleteRev deletes path only if it is still at rev, any rev when empty.
+func (dbox *Dropbox) deleteRev(ctx context.Context, path string, rev string) (Metadata, error) {
+	parm := map[string]interface{}{"path": apiPath(path)}
+	if rev != "" {
+		parm["parent_rev"] = rev
+	}
+	var result relocationResult
+	if err := dbox.rpc(ctx, "files/delete_v2", parm, &result); err != nil {
+		return Metadata{}, withPath(err, path)
 	}
+	return result.Metadata, nil
 }
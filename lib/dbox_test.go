@@ -0,0 +1,319 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/isyangban/gdbox/lib/dboxtest"
+)
+
+func newTestDropbox(t *testing.T) (*dboxtest.Server, *Dropbox) {
+	srv := dboxtest.NewServer()
+	t.Cleanup(srv.Close)
+	dbox := NewDropbox(Token{AccessToken: "token"})
+	dbox.ApiHost = srv.URL
+	dbox.ContentHost = srv.URL
+	dbox.NotifyHost = srv.URL
+	dbox.sleep = func(context.Context, time.Duration) error { return nil }
+	return srv, dbox
+}
+
+func TestApiPath(t *testing.T) {
+	tests := map[string]string{
+		"":           "",
+		"/":          "",
+		".":          "",
+		"a/b/":       "/a/b",
+		"/a//b":      "/a/b",
+		"id:abc":     "id:abc",
+		"/Photos/한글": "/Photos/한글",
+	}
+	for in, want := range tests {
+		if got := apiPath(in); got != want {
+			t.Errorf("apiPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestHeaderArg(t *testing.T) {
+	got, err := headerArg(map[string]string{"path": "/영재원/😀"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"path":"/\uc601\uc7ac\uc6d0/\ud83d\ude00"}`
+	if got != want {
+		t.Errorf("headerArg = %s, want %s", got, want)
+	}
+}
+
+func TestGetAccount(t *testing.T) {
+	_, dbox := newTestDropbox(t)
+	account, err := dbox.GetAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.AccountId == "" || account.Name.DisplayName == "" {
+		t.Errorf("GetAccount = %+v", account)
+	}
+}
+
+func TestGetMetaData(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/docs/a.txt", []byte("hello"))
+	srv.PutFile("/docs/sub/b.txt", []byte("world"))
+
+	file, err := dbox.GetMetaData("/docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.IsDir || file.Bytes != 5 || file.Rev != srv.Rev("/docs/a.txt") {
+		t.Errorf("file metadata = %+v", file)
+	}
+
+	folder, err := dbox.GetMetaData("/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !folder.IsDir || len(folder.Contents) != 2 {
+		t.Fatalf("folder metadata = %+v", folder)
+	}
+	if got := fileNames(folder); !reflect.DeepEqual(got, []string{"/docs/a.txt"}) {
+		t.Errorf("files = %v", got)
+	}
+
+	// An unchanged folder is served from the cache
+	listings := srv.Requests("files/list_folder")
+	if _, err := dbox.GetMetaData("/docs"); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Requests("files/list_folder") != listings {
+		t.Error("unchanged folder was listed again")
+	}
+	srv.PutFile("/docs/c.txt", nil)
+	folder, _ = dbox.GetMetaData("/docs")
+	if len(folder.Contents) != 3 {
+		t.Errorf("changed folder has %d entries, want 3", len(folder.Contents))
+	}
+
+	root, err := dbox.GetMetaData("/")
+	if err != nil || !root.IsDir || len(root.Contents) != 1 {
+		t.Errorf("root metadata = %+v, %v", root, err)
+	}
+
+	_, err = dbox.GetMetaData("/missing")
+	if api_err, ok := err.(*APIError); !ok || !api_err.HasTag("not_found") {
+		t.Errorf("missing path error = %v", err)
+	}
+}
+
+// fileNames returns the paths of the files in a folder listing.
+func fileNames(folder Metadata) []string {
+	var names []string
+	for _, entry := range folder.Contents {
+		if !entry.IsDir {
+			names = append(names, entry.Path)
+		}
+	}
+	return names
+}
+
+func TestListFolder(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PageLimit = 7
+	for i := 0; i < 250; i++ {
+		srv.PutFile(fmt.Sprintf("/big/%03d.txt", i), nil)
+	}
+	srv.PutFile("/big/sub/a.txt", nil)
+
+	folder, err := dbox.GetMetaData("/big")
+	if err != nil || len(folder.Contents) != 251 {
+		t.Fatalf("GetMetaData listed %d entries, %v", len(folder.Contents), err)
+	}
+	if got := len(fileNames(folder)); got != 250 {
+		t.Errorf("listing has %d files, want 250", got)
+	}
+	var files int
+	err = dbox.ListFolder("/big", true, func(entry Metadata) error {
+		if entry.Tag == "file" {
+			files++
+		}
+		return nil
+	})
+	if err != nil || files != 251 {
+		t.Errorf("ListFolder found %d files, %v", files, err)
+	}
+
+	stop := errors.New("stop")
+	listings := srv.Requests("files/list_folder/continue")
+	err = dbox.ListFolder("/big", false, func(entry Metadata) error { return stop })
+	if err != stop || srv.Requests("files/list_folder/continue") != listings {
+		t.Errorf("ListFolder did not stop: %v", err)
+	}
+}
+
+func TestFileOperations(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/a.txt", []byte("a"))
+
+	if _, err := dbox.CreateFolder("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbox.CreateFolder("/dir"); err == nil {
+		t.Error("creating an existing folder succeeded")
+	}
+	if m, err := dbox.Copy("/a.txt", "/dir/b.txt"); err != nil || m.Path != "/dir/b.txt" {
+		t.Fatalf("Copy = %+v, %v", m, err)
+	}
+	if _, err := dbox.Move("/a.txt", "/dir/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbox.Delete("/dir/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/dir", "/dir/c.txt"}
+	if got := srv.Paths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("paths = %v, want %v", got, want)
+	}
+	if _, err := dbox.Delete("/dir/b.txt"); err == nil {
+		t.Error("deleting a missing file succeeded")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/photos/summer trip.jpg", nil)
+	srv.PutFile("/photos/winter trip.jpg", nil)
+	srv.PutFile("/docs/trip plan.txt", nil)
+
+	result, err := dbox.Search("/photos", "trip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, m := range result {
+		paths = append(paths, m.Path)
+	}
+	sort.Strings(paths)
+	want := []string{"/photos/summer trip.jpg", "/photos/winter trip.jpg"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("Search = %v, want %v", paths, want)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/docs/a.txt", []byte("hello"))
+	dir := t.TempDir()
+
+	if err := dbox.Download("/docs/a.txt", filepath.Join(dir, "new", "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	// Downloading into a folder keeps the remote name
+	if err := dbox.Download("/docs/a.txt", dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"new/a.txt", "a.txt"} {
+		if data, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != "hello" {
+			t.Errorf("%s = %q, %v", name, data, err)
+		}
+	}
+	if err := dbox.Download("/docs/missing.txt", dir); err == nil {
+		t.Error("downloading a missing file succeeded")
+	}
+}
+
+func TestUpload(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "src", "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "src", "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "src", "sub", "b.txt"), []byte("b"), 0644)
+
+	if err := dbox.Upload("/dst", filepath.Join(dir, "src")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbox.Upload("/single/", filepath.Join(dir, "src", "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]string{"/dst/a.txt": "a", "/dst/sub/b.txt": "b", "/single/a.txt": "a"} {
+		if data, ok := srv.File(p); !ok || string(data) != want {
+			t.Errorf("%s = %q, %v", p, data, ok)
+		}
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	defer func(limit int64) { kDboxConst.DirectUploadSizeLimit = limit }(kDboxConst.DirectUploadSizeLimit)
+	kDboxConst.DirectUploadSizeLimit = 10
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4)
+	local := filepath.Join(t.TempDir(), "big.bin")
+	ioutil.WriteFile(local, data, 0644)
+	if err := dbox.Upload("/big.bin", local); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := srv.File("/big.bin"); !bytes.Equal(got, data) {
+		t.Errorf("uploaded %q, want %q", got, data)
+	}
+	if n := srv.Requests("files/upload_session/append_v2"); n != 6 {
+		t.Errorf("%d appends, want 6", n)
+	}
+}
+
+func TestConcurrentUpload(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	defer func(c dboxConst) { kDboxConst = c }(kDboxConst)
+	kDboxConst.DirectUploadSizeLimit, kDboxConst.ChunkAlign = 10, 8
+	srv.ChunkAlign = 8
+	// 20 byte chunks are rounded down to 16
+	dbox.ChunkSize, dbox.ChunkWorkers = 20, 3
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4)
+	data = append(data, "tail"...)
+	local := filepath.Join(t.TempDir(), "big.bin")
+	ioutil.WriteFile(local, data, 0644)
+	if err := dbox.Upload("/big.bin", local); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := srv.File("/big.bin"); !bytes.Equal(got, data) {
+		t.Errorf("uploaded %q, want %q", got, data)
+	}
+	if n := srv.Requests("files/upload_session/append_v2"); n != 5 {
+		t.Errorf("%d appends, want 5", n)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/a.txt", []byte("a"))
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := dbox.DownloadContext(ctx, "/a.txt", filepath.Join(dir, "a.txt")); !errors.Is(err, context.Canceled) {
+		t.Errorf("DownloadContext = %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); !os.IsNotExist(err) {
+		t.Error("canceled download left a file behind")
+	}
+
+	// Cancel while waiting to retry
+	dbox.sleep = sleepContext
+	srv.RetryAfter = 60
+	srv.FailNext("files/get_metadata", 429, 1)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := dbox.GetMetaDataContext(ctx, "/a.txt"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetMetaDataContext = %v, want context.DeadlineExceeded", err)
+	}
+}
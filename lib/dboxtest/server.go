@@ -0,0 +1,1237 @@
+// Package dboxtest provides an in-memory fake of the Dropbox api v2 for
+// tests. It implements the endpoints used by lib.Dropbox on a single
+// httptest server, so rpc, content and notify hosts all point to URL.
+package dboxtest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Size of the blocks used by the content hash
+const kBlockSize = 4 * 1024 * 1024
+
+// Modification times start at this instant and advance one second for
+// every change, so listings are deterministic.
+var kEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type entry struct {
+	path     string // display path
+	dir      bool
+	data     []byte
+	id       string
+	rev      string
+	modified time.Time
+	client   time.Time // client_modified, modified unless the upload set it
+	hash     string
+}
+
+type change struct {
+	seq     int
+	lower   string
+	deleted bool
+}
+
+type cursor struct {
+	path      string
+	recursive bool
+	seq       int
+	limit     int
+	pending   []interface{}
+}
+
+// authCode is a code given out by Authorize.
+type authCode struct {
+	app_key      string
+	challenge    string
+	redirect_uri string
+}
+
+type fault struct {
+	status  int
+	n       int
+	applied bool
+	corrupt bool
+}
+
+type session struct {
+	data   []byte
+	closed bool
+	// chunks of a concurrent session keyed by offset, end is the size
+	// announced by the closing append
+	concurrent bool
+	chunks     map[int64][]byte
+	end        int64
+}
+
+// Server is a fake Dropbox api server backed by an in-memory tree.
+type Server struct {
+	*httptest.Server
+
+	// Token is the only access token accepted, any token is accepted
+	// when it is empty.
+	Token string
+	// RetryAfter is sent in the Retry-After header of injected 429
+	// responses when it is not zero.
+	RetryAfter int
+	// ChunkAlign is the multiple that chunks of concurrent upload
+	// sessions must be sized and placed at, 4 MiB as on Dropbox.
+	ChunkAlign int64
+	// PageLimit caps the entries of a listing page when it is not zero,
+	// as the api may return fewer entries than the limit asked for.
+	PageLimit int
+	// Backoff is sent with every longpoll response when it is not zero,
+	// in seconds.
+	Backoff int
+	// RotateRefreshTokens makes a refresh return a new refresh token and
+	// invalidate the one used.
+	RotateRefreshTokens bool
+
+	mu       sync.Mutex
+	entries  map[string]*entry // keyed by lower case path
+	changes  []change
+	cursors  map[string]*cursor
+	sessions map[string]*session
+	seq      int
+	requests map[string]int
+	faults   map[string]*fault
+	// closed and replaced by every change, to wake longpolls
+	changed chan struct{}
+	codes   map[string]*authCode
+	tokens  int
+	refresh map[string]bool // valid refresh tokens
+	expired map[string]bool // access tokens refused as expired
+	revoked map[string]bool // access tokens refused as invalid
+}
+
+// NewServer starts a fake server with an empty root folder.
+// The caller should call Close when finished.
+func NewServer() *Server {
+	s := &Server{
+		ChunkAlign: 4 << 20,
+		entries:    make(map[string]*entry),
+		cursors:    make(map[string]*cursor),
+		sessions:   make(map[string]*session),
+		requests:   make(map[string]int),
+		faults:     make(map[string]*fault),
+		changed:    make(chan struct{}),
+		codes:      make(map[string]*authCode),
+		refresh:    make(map[string]bool),
+		expired:    make(map[string]bool),
+		revoked:    make(map[string]bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/2/users/get_current_account", s.rpc(s.getCurrentAccount))
+	mux.HandleFunc("/2/files/get_metadata", s.rpc(s.getMetadata))
+	mux.HandleFunc("/2/files/list_folder", s.rpc(s.listFolder))
+	mux.HandleFunc("/2/files/list_folder/continue", s.rpc(s.listFolderContinue))
+	mux.HandleFunc("/2/files/list_folder/longpoll", s.longpoll)
+	mux.HandleFunc("/oauth2/token", s.token)
+	mux.HandleFunc("/2/auth/token/revoke", s.revoke)
+	mux.HandleFunc("/2/files/copy_v2", s.rpc(s.copy))
+	mux.HandleFunc("/2/files/move_v2", s.rpc(s.move))
+	mux.HandleFunc("/2/files/delete_v2", s.rpc(s.delete))
+	mux.HandleFunc("/2/files/create_folder_v2", s.rpc(s.createFolder))
+	mux.HandleFunc("/2/files/search_v2", s.rpc(s.search))
+	mux.HandleFunc("/2/files/download", s.content(s.download))
+	mux.HandleFunc("/2/files/upload", s.content(s.upload))
+	mux.HandleFunc("/2/files/upload_session/start", s.content(s.uploadSessionStart))
+	mux.HandleFunc("/2/files/upload_session/append_v2", s.content(s.uploadSessionAppend))
+	mux.HandleFunc("/2/files/upload_session/finish", s.content(s.uploadSessionFinish))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// apiError is returned by handlers for 409 endpoint errors.
+type apiError struct {
+	union map[string]interface{}
+	tags  []string
+}
+
+// newError builds the nested union {".tag": tags[0], tags[0]: {".tag": tags[1], ...}}.
+func newError(tags ...string) *apiError {
+	var inner map[string]interface{}
+	for i := len(tags) - 1; i >= 0; i-- {
+		union := map[string]interface{}{".tag": tags[i]}
+		if inner != nil {
+			union[tags[i]] = inner
+		}
+		inner = union
+	}
+	return &apiError{union: inner, tags: tags}
+}
+
+// innermost returns the innermost union so extra fields can be added.
+func (e *apiError) innermost() map[string]interface{} {
+	union := e.union
+	for _, tag := range e.tags[:len(e.tags)-1] {
+		union = union[tag].(map[string]interface{})
+	}
+	return union
+}
+
+func (e *apiError) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error_summary": strings.Join(e.tags, "/") + "/..",
+		"error":         e.union,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func badRequest(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(w, "Error in call to API function: "+msg)
+}
+
+// authorize checks the bearer token and counts the request.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) bool {
+	s.requests[strings.TrimPrefix(r.URL.Path, "/2/")]++
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if s.expired[strings.TrimPrefix(auth, "Bearer ")] {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error_summary": "expired_access_token/..",
+			"error":         map[string]interface{}{".tag": "expired_access_token"},
+		})
+		return false
+	}
+	if !strings.HasPrefix(auth, "Bearer ") || (s.Token != "" && auth != "Bearer "+s.Token) || s.revoked[strings.TrimPrefix(auth, "Bearer ")] {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error_summary": "invalid_access_token/..",
+			"error":         map[string]interface{}{".tag": "invalid_access_token"},
+		})
+		return false
+	}
+	return true
+}
+
+type rpcHandler func(arg json.RawMessage) (interface{}, *apiError)
+
+func (s *Server) rpc(handle rpcHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.authorize(w, r) {
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) == 0 {
+			body = []byte("null")
+		}
+		if !json.Valid(body) {
+			badRequest(w, "could not decode input as JSON")
+			return
+		}
+		s.serve(w, r, func(w http.ResponseWriter) {
+			result, api_err := handle(body)
+			if api_err != nil {
+				api_err.write(w)
+				return
+			}
+			writeJSON(w, result)
+		})
+	}
+}
+
+type contentHandler func(w http.ResponseWriter, r *http.Request, arg json.RawMessage, body []byte) *apiError
+
+func (s *Server) content(handle contentHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.authorize(w, r) {
+			return
+		}
+		arg := r.Header.Get("Dropbox-API-Arg")
+		if arg == "" {
+			arg = r.URL.Query().Get("arg")
+		}
+		if !json.Valid([]byte(arg)) {
+			badRequest(w, "could not decode Dropbox-API-Arg header as JSON")
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if f := s.faults[strings.TrimPrefix(r.URL.Path, "/2/")]; f != nil && f.corrupt && f.n > 0 {
+			f.n--
+			if len(body) > 0 {
+				body[0] ^= 0xff
+			} else {
+				w = &corruptWriter{ResponseWriter: w}
+			}
+		}
+		s.serve(w, r, func(w http.ResponseWriter) {
+			if api_err := handle(w, r, json.RawMessage(arg), body); api_err != nil {
+				api_err.write(w)
+			}
+		})
+	}
+}
+
+// serve runs handle unless a failure was injected for the endpoint.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, handle func(w http.ResponseWriter)) {
+	endpoint := strings.TrimPrefix(r.URL.Path, "/2/")
+	f := s.faults[endpoint]
+	if f == nil || f.n == 0 || f.corrupt {
+		handle(w)
+		return
+	}
+	f.n--
+	if f.applied {
+		handle(httptest.NewRecorder())
+	}
+	if f.status == http.StatusTooManyRequests {
+		if s.RetryAfter > 0 {
+			w.Header().Set("Retry-After", fmt.Sprint(s.RetryAfter))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(f.status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error_summary": "too_many_requests/..",
+			"error": map[string]interface{}{
+				"reason":      map[string]interface{}{".tag": "too_many_requests"},
+				"retry_after": s.RetryAfter,
+			},
+		})
+		return
+	}
+	w.WriteHeader(f.status)
+	fmt.Fprint(w, http.StatusText(f.status))
+}
+
+// FailNext makes the next n calls to endpoint fail with status without
+// being processed.
+func (s *Server) FailNext(endpoint string, status int, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[endpoint] = &fault{status: status, n: n}
+}
+
+// LoseNext processes the next n calls to endpoint but answers them with
+// 503, as if the response was lost on the way back.
+func (s *Server) LoseNext(endpoint string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[endpoint] = &fault{status: http.StatusServiceUnavailable, n: n, applied: true}
+}
+
+// CorruptNext flips the first byte of the data the next n calls to a
+// content endpoint receive or, when they receive none, send.
+func (s *Server) CorruptNext(endpoint string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[endpoint] = &fault{n: n, corrupt: true}
+}
+
+// corruptWriter flips the first byte of a response body.
+type corruptWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *corruptWriter) Write(p []byte) (int, error) {
+	if !w.written && len(p) > 0 {
+		w.written = true
+		p = append([]byte{p[0] ^ 0xff}, p[1:]...)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Authorize does what the authorize page does when the user allows the
+// app app_key: it returns a code for the PKCE challenge and redirect uri
+// of the authorize url. Without a challenge the code needs the secret.
+func (s *Server) Authorize(app_key string, challenge string, redirect_uri string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code := fmt.Sprintf("code-%d", len(s.codes)+1)
+	s.codes[code] = &authCode{app_key: app_key, challenge: challenge, redirect_uri: redirect_uri}
+	return code
+}
+
+// ExpireTokens makes every access token handed out so far, and token,
+// be refused as expired.
+func (s *Server) ExpireTokens(tokens ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 1; i <= s.tokens; i++ {
+		s.expired[fmt.Sprintf("token-%d", i)] = true
+	}
+	for _, token := range tokens {
+		s.expired[token] = true
+	}
+}
+
+// revoke makes the access token of the request invalid from then on.
+func (s *Server) revoke(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorize(w, r) {
+		return
+	}
+	s.serve(w, r, func(w http.ResponseWriter) {
+		s.revoked[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] = true
+		writeJSON(w, nil)
+	})
+}
+
+// token is the oauth2 token endpoint. It hands out Token, or a new
+// token for every code or refresh when Token is empty.
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests["oauth2/token"]++
+	oauthError := func(oauth_err string, description string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": oauth_err, "error_description": description})
+	}
+	if r.Method != "POST" || r.ParseForm() != nil {
+		oauthError("invalid_request", "could not parse the request")
+		return
+	}
+	form := r.PostForm
+	s.tokens++
+	token := s.Token
+	if token == "" {
+		token = fmt.Sprintf("token-%d", s.tokens)
+	}
+	result := map[string]interface{}{
+		"access_token": token,
+		"token_type":   "bearer",
+		"expires_in":   14400,
+		"account_id":   "dbid:fake",
+		"uid":          "1",
+	}
+	if form.Get("grant_type") == "refresh_token" {
+		if !s.refresh[form.Get("refresh_token")] {
+			oauthError("invalid_grant", "refresh token is invalid or revoked")
+			return
+		}
+		// Refreshes do not tell the account
+		delete(result, "account_id")
+		delete(result, "uid")
+		if s.RotateRefreshTokens {
+			delete(s.refresh, form.Get("refresh_token"))
+			result["refresh_token"] = fmt.Sprintf("refresh-%d", s.tokens)
+			s.refresh[fmt.Sprintf("refresh-%d", s.tokens)] = true
+		}
+		writeJSON(w, result)
+		return
+	}
+	if form.Get("grant_type") != "authorization_code" {
+		oauthError("unsupported_grant_type", "grant_type "+form.Get("grant_type"))
+		return
+	}
+	code := s.codes[form.Get("code")]
+	delete(s.codes, form.Get("code"))
+	switch {
+	case code == nil:
+		oauthError("invalid_grant", "code doesn't exist or has expired")
+		return
+	case code.app_key != form.Get("client_id"):
+		oauthError("invalid_grant", "code was issued to another app")
+		return
+	case code.redirect_uri != form.Get("redirect_uri"):
+		oauthError("invalid_grant", "redirect_uri mismatch")
+		return
+	case code.challenge == "" && form.Get("client_secret") == "":
+		oauthError("invalid_client", "no client secret")
+		return
+	case code.challenge != "":
+		sum := sha256.Sum256([]byte(form.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge {
+			oauthError("invalid_grant", "invalid code verifier")
+			return
+		}
+	}
+	result["refresh_token"] = fmt.Sprintf("refresh-%d", s.tokens)
+	s.refresh[fmt.Sprintf("refresh-%d", s.tokens)] = true
+	writeJSON(w, result)
+}
+
+// ResetCursors forgets every cursor, so using one fails with reset as
+// when the server expires it.
+func (s *Server) ResetCursors() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cursors = make(map[string]*cursor)
+}
+
+// Requests returns how many times an endpoint such as "files/upload" was called.
+func (s *Server) Requests(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+// ContentHash computes the Dropbox content hash of data.
+func ContentHash(data []byte) string {
+	var blocks []byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > kBlockSize {
+			n = kBlockSize
+		}
+		sum := sha256.Sum256(data[:n])
+		blocks = append(blocks, sum[:]...)
+		data = data[n:]
+	}
+	sum := sha256.Sum256(blocks)
+	return hex.EncodeToString(sum[:])
+}
+
+func clean(p string) string {
+	if p == "" || p == "/" {
+		return ""
+	}
+	return path.Clean("/" + p)
+}
+
+func (s *Server) lookup(p string) *entry {
+	return s.entries[strings.ToLower(clean(p))]
+}
+
+// lookupRev finds the file whose current rev is rev.
+func (s *Server) lookupRev(rev string) *entry {
+	for _, e := range s.entries {
+		if !e.dir && e.rev == rev {
+			return e
+		}
+	}
+	return nil
+}
+
+// record advances the clock and logs a change for list_folder/continue.
+func (s *Server) record(lower string, deleted bool) time.Time {
+	s.seq++
+	s.changes = append(s.changes, change{seq: s.seq, lower: lower, deleted: deleted})
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return kEpoch.Add(time.Duration(s.seq) * time.Second)
+}
+
+// mkdirs creates p and all missing parents, it fails when a file is in the way.
+func (s *Server) mkdirs(p string) *apiError {
+	if p = clean(p); p == "" {
+		return nil
+	}
+	if e := s.lookup(p); e != nil {
+		if !e.dir {
+			return newError("path", "conflict", "file")
+		}
+		return nil
+	}
+	if err := s.mkdirs(path.Dir(p)); err != nil {
+		return err
+	}
+	lower := strings.ToLower(p)
+	s.record(lower, false)
+	s.entries[lower] = &entry{path: p, dir: true, id: fmt.Sprintf("id:%d", s.seq)}
+	return nil
+}
+
+// put stores data at p, replacing a file that is already there.
+func (s *Server) put(p string, data []byte) (*entry, *apiError) {
+	if err := s.mkdirs(path.Dir(p)); err != nil {
+		return nil, err
+	}
+	lower := strings.ToLower(p)
+	old := s.entries[lower]
+	if old != nil && old.dir {
+		return nil, newError("path", "conflict", "folder")
+	}
+	modified := s.record(lower, false)
+	e := &entry{
+		path:     p,
+		data:     append([]byte(nil), data...),
+		id:       fmt.Sprintf("id:%d", s.seq),
+		rev:      fmt.Sprintf("%09x", s.seq),
+		modified: modified,
+		client:   modified,
+		hash:     ContentHash(data),
+	}
+	if old != nil {
+		e.id = old.id
+	}
+	s.entries[lower] = e
+	return e, nil
+}
+
+// subtree returns p and every entry under it, sorted by path.
+func (s *Server) subtree(p string) []*entry {
+	lower := strings.ToLower(p)
+	var entries []*entry
+	for key, e := range s.entries {
+		if key == lower || strings.HasPrefix(key, lower+"/") {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.ToLower(entries[i].path) < strings.ToLower(entries[j].path)
+	})
+	return entries
+}
+
+func (s *Server) remove(p string) {
+	entries := s.subtree(p)
+	if len(entries) == 0 {
+		return
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		delete(s.entries, strings.ToLower(entries[i].path))
+	}
+	// Like Dropbox, one deletion for a folder and none for its contents
+	s.record(strings.ToLower(clean(p)), true)
+}
+
+func (e *entry) metadata() map[string]interface{} {
+	m := map[string]interface{}{
+		"name":         path.Base(e.path),
+		"id":           e.id,
+		"path_display": e.path,
+		"path_lower":   strings.ToLower(e.path),
+	}
+	if e.dir {
+		m[".tag"] = "folder"
+		return m
+	}
+	modified := e.modified.Format(time.RFC3339)
+	m[".tag"] = "file"
+	m["rev"] = e.rev
+	m["size"] = len(e.data)
+	m["client_modified"] = e.client.Format(time.RFC3339)
+	m["server_modified"] = modified
+	m["content_hash"] = e.hash
+	return m
+}
+
+func deletedMetadata(lower string) map[string]interface{} {
+	return map[string]interface{}{
+		".tag":         "deleted",
+		"name":         path.Base(lower),
+		"path_display": lower,
+		"path_lower":   lower,
+	}
+}
+
+// Mkdir creates a folder and its parents.
+func (s *Server) Mkdir(p string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.mkdirs(clean(p)); err != nil {
+		panic("dboxtest: mkdir " + p + ": " + strings.Join(err.tags, "/"))
+	}
+}
+
+// PutFile stores a file, creating parent folders, and returns its rev.
+func (s *Server) PutFile(p string, data []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, err := s.put(clean(p), data)
+	if err != nil {
+		panic("dboxtest: put " + p + ": " + strings.Join(err.tags, "/"))
+	}
+	return e.rev
+}
+
+// File returns the content of a file and whether it exists.
+func (s *Server) File(p string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.lookup(p)
+	if e == nil || e.dir {
+		return nil, false
+	}
+	return append([]byte(nil), e.data...), true
+}
+
+// IsDir reports whether a folder exists at p.
+func (s *Server) IsDir(p string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.lookup(p)
+	return clean(p) == "" || (e != nil && e.dir)
+}
+
+// Exists reports whether a file or folder exists at p.
+func (s *Server) Exists(p string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return clean(p) == "" || s.lookup(p) != nil
+}
+
+// Rev returns the current rev of a file, or "" if there is no such file.
+func (s *Server) Rev(p string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.lookup(p); e != nil {
+		return e.rev
+	}
+	return ""
+}
+
+// Paths returns the display path of every file and folder, sorted.
+func (s *Server) Paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var paths []string
+	for _, e := range s.entries {
+		paths = append(paths, e.path)
+	}
+	sort.Slice(paths, func(i, j int) bool { return strings.ToLower(paths[i]) < strings.ToLower(paths[j]) })
+	return paths
+}
+
+func (s *Server) getCurrentAccount(arg json.RawMessage) (interface{}, *apiError) {
+	return map[string]interface{}{
+		"account_id": "dbid:fake",
+		"name":       map[string]interface{}{"display_name": "Fake User", "given_name": "Fake", "surname": "User"},
+		"email":      "fake@example.com",
+		"locale":     "en",
+	}, nil
+}
+
+type pathArg struct {
+	Path string `json:"path"`
+}
+
+func (s *Server) getMetadata(arg json.RawMessage) (interface{}, *apiError) {
+	var parm pathArg
+	json.Unmarshal(arg, &parm)
+	e := s.lookup(parm.Path)
+	if e == nil {
+		return nil, newError("path", "not_found")
+	}
+	return e.metadata(), nil
+}
+
+// under reports whether lower is listed for a folder listing of root.
+func under(lower string, root string, recursive bool) bool {
+	if !strings.HasPrefix(lower, root+"/") {
+		return false
+	}
+	return recursive || !strings.Contains(lower[len(root)+1:], "/")
+}
+
+func (s *Server) newCursor(c *cursor) string {
+	id := fmt.Sprintf("cursor-%d", len(s.cursors)+1)
+	s.cursors[id] = c
+	return id
+}
+
+// page returns the next page of a cursor's pending entries.
+func (s *Server) page(id string, c *cursor) map[string]interface{} {
+	n := len(c.pending)
+	if c.limit > 0 && n > c.limit {
+		n = c.limit
+	}
+	if s.PageLimit > 0 && n > s.PageLimit {
+		n = s.PageLimit
+	}
+	entries := c.pending[:n]
+	c.pending = c.pending[n:]
+	if entries == nil {
+		entries = []interface{}{}
+	}
+	return map[string]interface{}{"entries": entries, "cursor": id, "has_more": len(c.pending) > 0}
+}
+
+func (s *Server) listFolder(arg json.RawMessage) (interface{}, *apiError) {
+	var parm struct {
+		Path      string `json:"path"`
+		Recursive bool   `json:"recursive"`
+		Limit     int    `json:"limit"`
+	}
+	json.Unmarshal(arg, &parm)
+	root := clean(parm.Path)
+	if root != "" {
+		e := s.lookup(root)
+		if e == nil {
+			return nil, newError("path", "not_found")
+		}
+		if !e.dir {
+			return nil, newError("path", "not_folder")
+		}
+	}
+	c := &cursor{path: strings.ToLower(root), recursive: parm.Recursive, seq: s.seq, limit: parm.Limit}
+	for _, e := range s.subtree(root) {
+		if under(strings.ToLower(e.path), c.path, c.recursive) {
+			c.pending = append(c.pending, e.metadata())
+		}
+	}
+	return s.page(s.newCursor(c), c), nil
+}
+
+func (s *Server) listFolderContinue(arg json.RawMessage) (interface{}, *apiError) {
+	var parm struct {
+		Cursor string `json:"cursor"`
+	}
+	json.Unmarshal(arg, &parm)
+	c := s.cursors[parm.Cursor]
+	if c == nil {
+		return nil, newError("reset")
+	}
+	if len(c.pending) == 0 {
+		// Report the latest state of every path changed since the cursor
+		seen := make(map[string]bool)
+		for _, ch := range s.changes {
+			if ch.seq <= c.seq || seen[ch.lower] || !under(ch.lower, c.path, c.recursive) {
+				continue
+			}
+			seen[ch.lower] = true
+			if e := s.entries[ch.lower]; e != nil {
+				c.pending = append(c.pending, e.metadata())
+			} else {
+				c.pending = append(c.pending, deletedMetadata(ch.lower))
+			}
+		}
+		c.seq = s.seq
+	}
+	return s.page(parm.Cursor, c), nil
+}
+
+// longpoll waits for a change under a cursor, for up to the timeout
+// asked for. Like the real endpoint it takes no access token, and
+// rejects requests that send one.
+func (s *Server) longpoll(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests["files/list_folder/longpoll"]++
+	if r.Header.Get("Authorization") != "" {
+		badRequest(w, "this function does not use the Authorization header")
+		return
+	}
+	var parm struct {
+		Cursor  string `json:"cursor"`
+		Timeout int    `json:"timeout"`
+	}
+	if json.NewDecoder(r.Body).Decode(&parm) != nil {
+		badRequest(w, "could not decode input as JSON")
+		return
+	}
+	if parm.Timeout == 0 {
+		parm.Timeout = 30
+	}
+	s.serve(w, r, func(w http.ResponseWriter) {
+		c := s.cursors[parm.Cursor]
+		if c == nil {
+			newError("reset").write(w)
+			return
+		}
+		timeout := time.NewTimer(time.Duration(parm.Timeout) * time.Second)
+		defer timeout.Stop()
+		result := map[string]interface{}{"changes": true}
+		for !s.changedSince(c) {
+			changed := s.changed
+			s.mu.Unlock()
+			select {
+			case <-changed:
+			case <-timeout.C:
+				result["changes"] = false
+			case <-r.Context().Done():
+			}
+			s.mu.Lock()
+			if result["changes"] == false || r.Context().Err() != nil {
+				break
+			}
+		}
+		if s.Backoff > 0 {
+			result["backoff"] = s.Backoff
+		}
+		writeJSON(w, result)
+	})
+}
+
+// changedSince reports whether anything under a cursor changed since it
+// was last read.
+func (s *Server) changedSince(c *cursor) bool {
+	if len(c.pending) > 0 {
+		return true
+	}
+	for i := len(s.changes) - 1; i >= 0 && s.changes[i].seq > c.seq; i-- {
+		if under(s.changes[i].lower, c.path, c.recursive) {
+			return true
+		}
+	}
+	return false
+}
+
+type relocationArg struct {
+	FromPath string `json:"from_path"`
+	ToPath   string `json:"to_path"`
+}
+
+// relocate copies the tree at from_path to to_path.
+func (s *Server) relocate(arg json.RawMessage) (*entry, *relocationArg, *apiError) {
+	var parm relocationArg
+	json.Unmarshal(arg, &parm)
+	from, to := clean(parm.FromPath), clean(parm.ToPath)
+	src := s.lookup(from)
+	if src == nil {
+		return nil, nil, newError("from_lookup", "not_found")
+	}
+	if s.lookup(to) != nil {
+		return nil, nil, newError("to", "conflict", "file")
+	}
+	lower := strings.ToLower(from)
+	if strings.HasPrefix(strings.ToLower(to)+"/", lower+"/") {
+		return nil, nil, newError("cant_move_folder_into_itself")
+	}
+	for _, e := range s.subtree(from) {
+		target := to + e.path[len(from):]
+		if e.dir {
+			s.mkdirs(target)
+		} else {
+			s.put(target, e.data)
+		}
+	}
+	return s.lookup(to), &parm, nil
+}
+
+func (s *Server) copy(arg json.RawMessage) (interface{}, *apiError) {
+	e, _, err := s.relocate(arg)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"metadata": e.metadata()}, nil
+}
+
+func (s *Server) move(arg json.RawMessage) (interface{}, *apiError) {
+	e, parm, err := s.relocate(arg)
+	if err != nil {
+		return nil, err
+	}
+	s.remove(clean(parm.FromPath))
+	return map[string]interface{}{"metadata": e.metadata()}, nil
+}
+
+func (s *Server) delete(arg json.RawMessage) (interface{}, *apiError) {
+	var parm struct {
+		Path      string `json:"path"`
+		ParentRev string `json:"parent_rev"`
+	}
+	json.Unmarshal(arg, &parm)
+	e := s.lookup(parm.Path)
+	if e == nil {
+		return nil, newError("path_lookup", "not_found")
+	}
+	if parm.ParentRev != "" && parm.ParentRev != e.rev {
+		return nil, newError("path_write", "conflict", "file")
+	}
+	s.remove(e.path)
+	return map[string]interface{}{"metadata": e.metadata()}, nil
+}
+
+func (s *Server) createFolder(arg json.RawMessage) (interface{}, *apiError) {
+	var parm pathArg
+	json.Unmarshal(arg, &parm)
+	p := clean(parm.Path)
+	if p == "" {
+		return nil, newError("path", "malformed_path")
+	}
+	if e := s.lookup(p); e != nil {
+		if e.dir {
+			return nil, newError("path", "conflict", "folder")
+		}
+		return nil, newError("path", "conflict", "file")
+	}
+	if err := s.mkdirs(p); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"metadata": s.lookup(p).metadata()}, nil
+}
+
+func (s *Server) search(arg json.RawMessage) (interface{}, *apiError) {
+	var parm struct {
+		Query   string `json:"query"`
+		Options struct {
+			Path       string `json:"path"`
+			MaxResults int    `json:"max_results"`
+		} `json:"options"`
+	}
+	json.Unmarshal(arg, &parm)
+	root := clean(parm.Options.Path)
+	words := strings.Fields(strings.ToLower(parm.Query))
+	matches := []interface{}{}
+	for _, e := range s.subtree(root) {
+		lower := strings.ToLower(e.path)
+		if root != "" && lower == strings.ToLower(root) {
+			continue
+		}
+		name := path.Base(lower)
+		found := len(words) > 0
+		for _, word := range words {
+			found = found && strings.Contains(name, word)
+		}
+		if !found {
+			continue
+		}
+		if parm.Options.MaxResults > 0 && len(matches) == parm.Options.MaxResults {
+			break
+		}
+		matches = append(matches, map[string]interface{}{
+			"match_type": map[string]interface{}{".tag": "filename"},
+			"metadata":   map[string]interface{}{".tag": "metadata", "metadata": e.metadata()},
+		})
+	}
+	return map[string]interface{}{"matches": matches, "has_more": false}, nil
+}
+
+func (s *Server) download(w http.ResponseWriter, r *http.Request, arg json.RawMessage, body []byte) *apiError {
+	var parm pathArg
+	json.Unmarshal(arg, &parm)
+	e := s.lookup(parm.Path)
+	if strings.HasPrefix(parm.Path, "rev:") {
+		e = s.lookupRev(strings.TrimPrefix(parm.Path, "rev:"))
+	}
+	if e == nil {
+		return newError("path", "not_found")
+	}
+	if e.dir {
+		return newError("path", "not_file")
+	}
+	result, _ := json.Marshal(e.metadata())
+	w.Header().Set("Dropbox-API-Result", string(result))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	data := e.data
+	var start, end int
+	if n, _ := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); n > 0 {
+		if n == 1 || end >= len(data) {
+			end = len(data) - 1
+		}
+		if start >= len(data) || start > end {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return nil
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start : end+1])
+		return nil
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.Write(data)
+	return nil
+}
+
+type commitInfo struct {
+	Path           string          `json:"path"`
+	Mode           json.RawMessage `json:"mode"`
+	Autorename     bool            `json:"autorename"`
+	ClientModified string          `json:"client_modified"`
+}
+
+// commit writes data following the write mode of a commit info.
+func (s *Server) commit(info commitInfo, data []byte) (*entry, *apiError) {
+	p := clean(info.Path)
+	if p == "" {
+		return nil, newError("path", "malformed_path")
+	}
+	var mode struct {
+		Tag    string `json:".tag"`
+		Update string `json:"update"`
+	}
+	if json.Unmarshal(info.Mode, &mode.Tag) != nil {
+		json.Unmarshal(info.Mode, &mode)
+	}
+	if mode.Tag == "" {
+		mode.Tag = "add"
+	}
+	old := s.lookup(p)
+	conflict := false
+	switch {
+	case old == nil:
+	case old.dir:
+		conflict = true
+	case mode.Tag == "add":
+		if old.hash == ContentHash(data) {
+			return old, nil
+		}
+		conflict = true
+	case mode.Tag == "update":
+		conflict = old.rev != mode.Update
+	}
+	if old == nil && mode.Tag == "update" {
+		conflict = true
+	}
+	if conflict {
+		if !info.Autorename || old == nil {
+			return nil, newError("path", "conflict", "file")
+		}
+		ext := path.Ext(p)
+		base := strings.TrimSuffix(p, ext)
+		for i := 1; ; i++ {
+			p = fmt.Sprintf("%s (%d)%s", base, i, ext)
+			if s.lookup(p) == nil {
+				break
+			}
+		}
+	}
+	e, err := s.put(p, data)
+	if err == nil && info.ClientModified != "" {
+		if client, parse_err := time.Parse(time.RFC3339, info.ClientModified); parse_err == nil {
+			e.client = client
+		}
+	}
+	return e, err
+}
+
+func (s *Server) upload(w http.ResponseWriter, r *http.Request, arg json.RawMessage, body []byte) *apiError {
+	var info commitInfo
+	json.Unmarshal(arg, &info)
+	e, err := s.commit(info, body)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, e.metadata())
+	return nil
+}
+
+type sessionCursor struct {
+	SessionId string `json:"session_id"`
+	Offset    int64  `json:"offset"`
+}
+
+func (s *Server) uploadSessionStart(w http.ResponseWriter, r *http.Request, arg json.RawMessage, body []byte) *apiError {
+	var parm struct {
+		Close       bool   `json:"close"`
+		SessionType string `json:"session_type"`
+	}
+	json.Unmarshal(arg, &parm)
+	sess := &session{data: append([]byte(nil), body...), closed: parm.Close}
+	if parm.SessionType == "concurrent" {
+		if len(body) > 0 {
+			return newError("concurrent_session_data_not_allowed")
+		}
+		if parm.Close {
+			return newError("concurrent_session_close_not_allowed")
+		}
+		sess.concurrent, sess.chunks = true, make(map[int64][]byte)
+	}
+	id := fmt.Sprintf("session-%d", len(s.sessions)+1)
+	s.sessions[id] = sess
+	writeJSON(w, map[string]interface{}{"session_id": id})
+	return nil
+}
+
+// session looks up an upload session and checks the offset.
+func (s *Server) session(c sessionCursor) (*session, *apiError) {
+	sess := s.sessions[c.SessionId]
+	if sess == nil {
+		return nil, newError("not_found")
+	}
+	if sess.concurrent {
+		return sess, nil
+	}
+	if c.Offset != int64(len(sess.data)) {
+		err := newError("incorrect_offset")
+		err.innermost()["correct_offset"] = len(sess.data)
+		return nil, err
+	}
+	return sess, nil
+}
+
+func (s *Server) uploadSessionAppend(w http.ResponseWriter, r *http.Request, arg json.RawMessage, body []byte) *apiError {
+	var parm struct {
+		Cursor sessionCursor `json:"cursor"`
+		Close  bool          `json:"close"`
+	}
+	json.Unmarshal(arg, &parm)
+	sess, err := s.session(parm.Cursor)
+	if err != nil {
+		return err
+	}
+	if sess.closed {
+		return newError("closed")
+	}
+	if sess.concurrent {
+		// Chunks may come in any order, only the last may be unaligned
+		if parm.Cursor.Offset%s.ChunkAlign != 0 {
+			return newError("concurrent_session_invalid_offset")
+		}
+		if !parm.Close && int64(len(body))%s.ChunkAlign != 0 {
+			return newError("concurrent_session_invalid_data_size")
+		}
+		sess.chunks[parm.Cursor.Offset] = append([]byte(nil), body...)
+		if parm.Close {
+			sess.closed, sess.end = true, parm.Cursor.Offset+int64(len(body))
+		}
+		writeJSON(w, nil)
+		return nil
+	}
+	sess.data = append(sess.data, body...)
+	sess.closed = parm.Close
+	writeJSON(w, nil)
+	return nil
+}
+
+// assemble joins the chunks of a closed concurrent session.
+func (sess *session) assemble() ([]byte, *apiError) {
+	if !sess.closed {
+		return nil, newError("concurrent_session_not_closed")
+	}
+	var data []byte
+	for int64(len(data)) < sess.end {
+		chunk, ok := sess.chunks[int64(len(data))]
+		if !ok || len(chunk) == 0 {
+			return nil, newError("concurrent_session_missing_data")
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+func (s *Server) uploadSessionFinish(w http.ResponseWriter, r *http.Request, arg json.RawMessage, body []byte) *apiError {
+	var parm struct {
+		Cursor sessionCursor `json:"cursor"`
+		Commit commitInfo    `json:"commit"`
+	}
+	json.Unmarshal(arg, &parm)
+	sess, err := s.session(parm.Cursor)
+	if err != nil {
+		err.tags = append([]string{"lookup_failed"}, err.tags...)
+		err.union = map[string]interface{}{".tag": "lookup_failed", "lookup_failed": err.union}
+		return err
+	}
+	data := append(sess.data, body...)
+	if sess.concurrent {
+		if len(body) > 0 {
+			return newError("concurrent_session_data_not_allowed")
+		}
+		if data, err = sess.assemble(); err != nil {
+			return err
+		}
+	}
+	e, err := s.commit(parm.Commit, data)
+	if err != nil {
+		return err
+	}
+	delete(s.sessions, parm.Cursor.SessionId)
+	writeJSON(w, e.metadata())
+	return nil
+}
@@ -0,0 +1,257 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// DownloadTo streams a remote file into w and returns its metadata.
+func (dbox *Dropbox) DownloadTo(remote_path string, w io.Writer) (Metadata, error) {
+	return dbox.DownloadToContext(context.Background(), remote_path, w)
+}
+
+// DownloadToContext is DownloadTo with a context. The data is checked
+// against the content hash, ErrHashMismatch is returned after all of it
+// was written to w.
+func (dbox *Dropbox) DownloadToContext(ctx context.Context, remote_path string, w io.Writer) (Metadata, error) {
+	resp, err := dbox.content(ctx, "files/download", map[string]interface{}{"path": apiPath(remote_path)}, nil)
+	if err != nil {
+		return Metadata{}, withPath(err, remote_path)
+	}
+	defer resp.Body.Close()
+	metadata := *NewMetadata([]byte(resp.Header.Get("Dropbox-API-Result")))
+	h := NewContentHash()
+	n, err := io.Copy(io.MultiWriter(w, h), resp.Body)
+	if err != nil {
+		return metadata, err
+	}
+	if n != metadata.Bytes {
+		return metadata, fmt.Errorf("%w: %s: got %d bytes, expected %d", ErrSizeMismatch, remote_path, n, metadata.Bytes)
+	}
+	return metadata, checkHash(h, metadata, remote_path)
+}
+
+//TODO: If there is no folders then make folders first
+// Download saves a remote file to local_path, or into local_path when it
+// is a folder. The file is written to a temporary file next to the
+// target and renamed into place once complete, so an interrupted
+// download never leaves a corrupt target. A download not matching the
+// content hash is tried again.
+func (dbox *Dropbox) Download(remote_path string, local_path string) error {
+	return dbox.DownloadContext(context.Background(), remote_path, local_path)
+}
+
+// DownloadContext is Download with a context.
+func (dbox *Dropbox) DownloadContext(ctx context.Context, remote_path string, local_path string) error {
+	os.MkdirAll(filepath.Dir(local_path), 0755)
+	if stat, err := os.Stat(local_path); err == nil && stat.IsDir() {
+		local_path = filepath.Join(local_path, filepath.Base(remote_path))
+	}
+	dir, base := filepath.Split(local_path)
+	return dbox.retryMismatch(ctx, func() error {
+		tmp, err := ioutil.TempFile(dir, "."+base+".gdbox-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name()) // no-op after the rename
+		if _, err := dbox.DownloadToContext(ctx, remote_path, tmp); err != nil {
+			tmp.Close()
+			return err
+		}
+		return commitFile(tmp, local_path)
+	})
+}
+
+// commitFile flushes and closes f, then atomically renames it to path.
+func commitFile(f *os.File, path string) error {
+	err := f.Sync()
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		return err
+	}
+	// Make the rename itself durable
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Suffix of resumable partial downloads, the sidecar adds ".json"
+const kPartialSuffix = ".gdboxpart"
+
+// partialDownload is the sidecar of a partial download. It records
+// which rev of the remote file the partial file belongs to.
+type partialDownload struct {
+	Path   string `json:"path"`
+	Rev    string `json:"rev"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+}
+
+func loadPartial(sidecar string) (partialDownload, bool) {
+	var partial partialDownload
+	data, err := ioutil.ReadFile(sidecar)
+	if err != nil || json.Unmarshal(data, &partial) != nil {
+		return partialDownload{}, false
+	}
+	return partial, true
+}
+
+func (p partialDownload) save(sidecar string) error {
+	data, _ := json.Marshal(p)
+	return ioutil.WriteFile(sidecar, data, 0644)
+}
+
+// DownloadResume is Download keeping what was received when it fails.
+// The data goes to local_path+".gdboxpart" with a sidecar recording the
+// remote rev and offset. A later call continues with a Range request if
+// the remote rev is unchanged, otherwise it starts over.
+func (dbox *Dropbox) DownloadResume(remote_path string, local_path string) error {
+	return dbox.DownloadResumeContext(context.Background(), remote_path, local_path)
+}
+
+// DownloadResumeContext is DownloadResume with a context.
+func (dbox *Dropbox) DownloadResumeContext(ctx context.Context, remote_path string, local_path string) error {
+	os.MkdirAll(filepath.Dir(local_path), 0755)
+	if stat, err := os.Stat(local_path); err == nil && stat.IsDir() {
+		local_path = filepath.Join(local_path, filepath.Base(remote_path))
+	}
+	return dbox.retryMismatch(ctx, func() error {
+		return dbox.downloadResume(ctx, remote_path, local_path)
+	})
+}
+
+func (dbox *Dropbox) downloadResume(ctx context.Context, remote_path string, local_path string) error {
+	metadata, err := dbox.StatContext(ctx, remote_path)
+	if err != nil {
+		return err
+	}
+	if metadata.IsDir {
+		return fmt.Errorf("dropbox: %s: is a folder", remote_path)
+	}
+	part_path := local_path + kPartialSuffix
+	sidecar := part_path + ".json"
+	f, err := os.OpenFile(part_path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	partial, ok := loadPartial(sidecar)
+	if !ok || partial.Rev != metadata.Rev || partial.Path != metadata.PathLower {
+		// Changed remotely or never started, begin from byte zero
+		partial = partialDownload{Path: metadata.PathLower, Rev: metadata.Rev, Size: metadata.Bytes}
+	}
+	// All of the partial file came from the rev of the sidecar, which is
+	// saved before any of it. The offset there is only as recent as the
+	// last clean stop, a killed download resumes from what reached the
+	// file instead; the content hash catches a torn end.
+	partial.Offset = 0
+	if stat, err := f.Stat(); err == nil && ok && partial.Rev == metadata.Rev && stat.Size() <= metadata.Bytes {
+		partial.Offset = stat.Size()
+	}
+	if err := f.Truncate(partial.Offset); err != nil {
+		f.Close()
+		return err
+	}
+	if err := partial.save(sidecar); err != nil {
+		f.Close()
+		return err
+	}
+
+	h := NewContentHash()
+	var received int64
+	if partial.Offset == metadata.Bytes {
+		// Killed after the last byte but before the rename, there is
+		// nothing to ask for
+		received, err = io.Copy(h, io.NewSectionReader(f, 0, partial.Offset))
+	} else {
+		received, err = dbox.downloadRange(ctx, "rev:"+metadata.Rev, f, partial.Offset, h)
+	}
+	if err != nil {
+		// Keep what made it to disk for the next try
+		if f.Sync() == nil {
+			partial.Offset = received
+			partial.save(sidecar)
+		}
+		f.Close()
+		return withPath(err, remote_path)
+	}
+	if received != metadata.Bytes {
+		err = fmt.Errorf("%w: %s: got %d bytes, expected %d", ErrSizeMismatch, remote_path, received, metadata.Bytes)
+	} else {
+		err = checkHash(h, metadata, remote_path)
+	}
+	if err != nil {
+		// The partial data is bad, the next try starts over
+		f.Close()
+		os.Remove(part_path)
+		os.Remove(sidecar)
+		return err
+	}
+	if err := commitFile(f, local_path); err != nil {
+		return err
+	}
+	os.Remove(sidecar)
+	return nil
+}
+
+// downloadRange writes a remote file from offset on into f at offset and
+// returns the size of f's content afterwards. h ends up with the hash of
+// all of f.
+func (dbox *Dropbox) downloadRange(ctx context.Context, remote_path string, f *os.File, offset int64, h hash.Hash) (int64, error) {
+	api_arg, err := headerArg(map[string]interface{}{"path": remote_path})
+	if err != nil {
+		return offset, err
+	}
+	resp, err := dbox.do(ctx, "files/download", func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", endpointURL(dbox.ContentHost, "2/files/download"), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Dropbox-API-Arg", api_arg)
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		return req, nil
+	})
+	var api_err *APIError
+	if offset > 0 && errors.As(err, &api_err) && api_err.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// The partial file is not a prefix of the rev, start over
+		return dbox.downloadRange(ctx, remote_path, f, 0, h)
+	}
+	if err != nil {
+		return offset, err
+	}
+	defer resp.Body.Close()
+	h.Reset()
+	if resp.StatusCode != http.StatusPartialContent {
+		// The whole file was sent
+		offset = 0
+	} else if _, err := io.Copy(h, io.NewSectionReader(f, 0, offset)); err != nil {
+		return offset, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	if err := f.Truncate(offset); err != nil {
+		return offset, err
+	}
+	n, err := io.Copy(io.MultiWriter(f, h), resp.Body)
+	return offset + n, err
+}
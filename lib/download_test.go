@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadTo(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/a.txt", []byte("hello"))
+
+	var buf bytes.Buffer
+	metadata, err := dbox.DownloadTo("/a.txt", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "hello" || metadata.Rev != srv.Rev("/a.txt") {
+		t.Errorf("DownloadTo = %q, %+v", buf.String(), metadata)
+	}
+}
+
+func TestDownloadSizeMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Dropbox-API-Result", `{".tag": "file", "path_display": "/a.txt", "size": 10}`)
+		w.Write([]byte("short"))
+	}))
+	defer srv.Close()
+	dbox := NewDropbox(Token{AccessToken: "token"})
+	dbox.ContentHost = srv.URL
+	dir := t.TempDir()
+
+	if err := dbox.Download("/a.txt", dir); !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("Download = %v, want ErrSizeMismatch", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("failed download left %d files in %s", len(files), filepath.Base(dir))
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	rev := srv.PutFile("/a.txt", []byte("hello world"))
+	dir := t.TempDir()
+	target := filepath.Join(dir, "a.txt")
+	part := target + kPartialSuffix
+
+	ioutil.WriteFile(part, []byte("hello"), 0644)
+	partialDownload{Path: "/a.txt", Rev: rev, Size: 11, Offset: 5}.save(part + ".json")
+	if err := dbox.DownloadResume("/a.txt", target); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(target); string(data) != "hello world" {
+		t.Errorf("resumed download = %q", data)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files left after a complete download", len(files))
+	}
+
+	// A corrupt partial file fails the content hash and is fetched again
+	ioutil.WriteFile(part, []byte("HELLO"), 0644)
+	partialDownload{Path: "/a.txt", Rev: rev, Size: 11, Offset: 5}.save(part + ".json")
+	downloads := srv.Requests("files/download")
+	if err := dbox.DownloadResume("/a.txt", target); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(target); string(data) != "hello world" {
+		t.Errorf("download after a hash mismatch = %q", data)
+	}
+	if n := srv.Requests("files/download") - downloads; n != 2 {
+		t.Errorf("%d downloads, want 2", n)
+	}
+
+	// A partial file of an older rev is discarded
+	ioutil.WriteFile(part, []byte("HELLO"), 0644)
+	partialDownload{Path: "/a.txt", Rev: "old", Size: 11, Offset: 5}.save(part + ".json")
+	if err := dbox.DownloadResume("/a.txt", target); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(target); string(data) != "hello world" {
+		t.Errorf("restarted download = %q", data)
+	}
+}
+
+func TestDownloadResumeKeepsPartial(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/a.txt", []byte("hello"))
+	target := filepath.Join(t.TempDir(), "a.txt")
+
+	srv.FailNext("files/download", 500, dbox.MaxTries)
+	if err := dbox.DownloadResume("/a.txt", target); err == nil {
+		t.Fatal("DownloadResume succeeded on a failing server")
+	}
+	if _, ok := loadPartial(target + kPartialSuffix + ".json"); !ok {
+		t.Error("failed download did not keep its sidecar")
+	}
+	if err := dbox.DownloadResume("/a.txt", target); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(target); string(data) != "hello" {
+		t.Errorf("download = %q", data)
+	}
+}
+
+func TestDownloadResumeAfterKill(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/a.txt", []byte("hello world"))
+	// Records the ranges asked for on the way to the fake server
+	var ranges []string
+	target_url, _ := url.Parse(srv.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target_url)
+	content := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		proxy.ServeHTTP(w, r)
+	}))
+	defer content.Close()
+	dbox.ContentHost = content.URL
+	target := filepath.Join(t.TempDir(), "a.txt")
+	part := target + kPartialSuffix
+
+	// Killed after writing data, the sidecar still has the offset it
+	// was started with
+	ioutil.WriteFile(part, []byte("hello"), 0644)
+	partialDownload{Path: "/a.txt", Rev: srv.Rev("/a.txt"), Size: 11}.save(part + ".json")
+	if err := dbox.DownloadResume("/a.txt", target); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(target); string(data) != "hello world" {
+		t.Errorf("download = %q", data)
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=5-" {
+		t.Errorf("ranges %q, want the download resumed at byte 5", ranges)
+	}
+}
+
+func TestDownloadResumeComplete(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/a.txt", []byte("hello"))
+	target := filepath.Join(t.TempDir(), "a.txt")
+	part := target + kPartialSuffix
+
+	// Killed after the last byte, before the rename
+	ioutil.WriteFile(part, []byte("hello"), 0644)
+	partialDownload{Path: "/a.txt", Rev: srv.Rev("/a.txt"), Size: 5}.save(part + ".json")
+	if err := dbox.DownloadResume("/a.txt", target); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(target); string(data) != "hello" {
+		t.Errorf("download = %q", data)
+	}
+	if n := srv.Requests("files/download"); n != 0 {
+		t.Errorf("%d downloads of a complete partial file", n)
+	}
+}
+
+func TestDownloadResumeUnsatisfiable(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/a.txt", []byte("hello world"))
+	// Refuses every range, as for a partial file longer than the rev
+	target_url, _ := url.Parse(srv.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target_url)
+	content := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer content.Close()
+	dbox.ContentHost = content.URL
+	target := filepath.Join(t.TempDir(), "a.txt")
+	part := target + kPartialSuffix
+
+	ioutil.WriteFile(part, []byte("hello"), 0644)
+	partialDownload{Path: "/a.txt", Rev: srv.Rev("/a.txt"), Size: 11}.save(part + ".json")
+	if err := dbox.DownloadResume("/a.txt", target); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(target); string(data) != "hello world" {
+		t.Errorf("download = %q", data)
+	}
+}
@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error kinds, use errors.Is to check an error returned by Dropbox
+// methods against them.
+var (
+	ErrNotFound          = errors.New("dropbox: not found")
+	ErrConflict          = errors.New("dropbox: conflict")
+	ErrInsufficientSpace = errors.New("dropbox: insufficient space")
+	ErrRateLimited       = errors.New("dropbox: rate limited")
+	ErrUnauthorized      = errors.New("dropbox: unauthorized")
+	ErrExpiredToken      = errors.New("dropbox: access token expired")
+	ErrForbidden         = errors.New("dropbox: access denied")
+	ErrBadRequest        = errors.New("dropbox: bad request")
+	ErrServer            = errors.New("dropbox: server error")
+	// ErrSizeMismatch means a transfer ended with a different size than
+	// the metadata announced.
+	ErrSizeMismatch = errors.New("dropbox: size does not match metadata")
+	// ErrHashMismatch means the data of a transfer does not match the
+	// content_hash of the metadata.
+	ErrHashMismatch = errors.New("dropbox: content hash does not match metadata")
+)
+
+// APIError is the error returned by the api for a failed request.
+// Endpoint specific errors (409) are tagged unions, Tags holds the
+// chain of tags from the outer union to the innermost one,
+// e.g. error_summary "path/not_found/.." becomes ["path", "not_found"].
+type APIError struct {
+	StatusCode int
+	Endpoint   string
+	Path       string
+	Summary    string
+	Tags       []string
+	Detail     json.RawMessage
+	// RetryAfter is how long the server asked to wait before retrying,
+	// zero if it did not say.
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	msg := e.Summary
+	if msg == "" {
+		msg = fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	if e.Path != "" {
+		return "dropbox: " + e.Path + ": " + msg
+	}
+	return "dropbox: " + e.Endpoint + ": " + msg
+}
+
+// HasTag reports whether tag appears anywhere in the error's tag chain.
+func (e *APIError) HasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Is maps the status code and tags to the Err* kinds.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == 409 && e.HasTag("not_found")
+	case ErrConflict:
+		return e.StatusCode == 409 && e.HasTag("conflict")
+	case ErrInsufficientSpace:
+		return e.HasTag("insufficient_space")
+	case ErrRateLimited:
+		return e.StatusCode == 429 || e.HasTag("too_many_write_operations")
+	case ErrUnauthorized:
+		return e.StatusCode == 401
+	case ErrExpiredToken:
+		return e.StatusCode == 401 && e.HasTag("expired_access_token")
+	case ErrForbidden:
+		return e.StatusCode == 403
+	case ErrBadRequest:
+		return e.StatusCode == 400
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+func newAPIError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	api_err := &APIError{
+		StatusCode: resp.StatusCode,
+		Endpoint:   strings.TrimPrefix(resp.Request.URL.Path, "/2/"),
+	}
+	var parsed struct {
+		ErrorSummary string          `json:"error_summary"`
+		Error        json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(body, &parsed) == nil && parsed.Error != nil {
+		api_err.Summary = parsed.ErrorSummary
+		api_err.Detail = parsed.Error
+		api_err.Tags = unionTags(parsed.Error)
+		// 429 bodies carry {"reason": {...}, "retry_after": seconds}
+		var rate_limit struct {
+			Reason     json.RawMessage `json:"reason"`
+			RetryAfter int             `json:"retry_after"`
+		}
+		if json.Unmarshal(parsed.Error, &rate_limit) == nil && rate_limit.Reason != nil {
+			api_err.Tags = unionTags(rate_limit.Reason)
+			api_err.RetryAfter = time.Duration(rate_limit.RetryAfter) * time.Second
+		}
+		if api_err.Summary == "" {
+			// oauth2 errors are {"error": "invalid_grant", "error_description": ".."}
+			var oauth_err string
+			json.Unmarshal(parsed.Error, &oauth_err)
+			api_err.Summary = oauth_err
+			if oauth_err != "" {
+				api_err.Tags = []string{oauth_err}
+			}
+		}
+	} else {
+		// 400 and 5xx responses are plain text
+		api_err.Summary = strings.TrimSpace(string(body))
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		api_err.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return api_err
+}
+
+// unionTags walks a nested tagged union and collects every ".tag" value.
+func unionTags(raw json.RawMessage) []string {
+	var tags []string
+	for len(raw) > 0 {
+		var union map[string]json.RawMessage
+		if json.Unmarshal(raw, &union) != nil {
+			break
+		}
+		var tag string
+		if json.Unmarshal(union[".tag"], &tag) != nil || tag == "" {
+			break
+		}
+		tags = append(tags, tag)
+		raw = union[tag]
+		if len(raw) > 0 && raw[0] != '{' {
+			break
+		}
+	}
+	return tags
+}
+
+// withPath records the path an api error refers to.
+func withPath(err error, path string) error {
+	var api_err *APIError
+	if errors.As(err, &api_err) && api_err.Path == "" {
+		api_err.Path = path
+	}
+	return err
+}
+
+// relocationError records which side of a copy or move failed.
+func relocationError(err error, from_path string, to_path string) error {
+	var api_err *APIError
+	if errors.As(err, &api_err) && api_err.HasTag("to") {
+		return withPath(err, to_path)
+	}
+	return withPath(err, from_path)
+}
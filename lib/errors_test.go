@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestErrorKinds(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/a.txt", []byte("a"))
+	srv.Mkdir("/dir")
+
+	_, err := dbox.GetMetaData("/missing")
+	var api_err *APIError
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &api_err) || api_err.Path != "/missing" {
+		t.Errorf("GetMetaData of a missing path = %v", err)
+	}
+	if err := dbox.Download("/missing", t.TempDir()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Download of a missing path = %v", err)
+	}
+	if _, err := dbox.CreateFolder("/dir"); !errors.Is(err, ErrConflict) || errors.Is(err, ErrNotFound) {
+		t.Errorf("CreateFolder of an existing folder = %v", err)
+	}
+	_, err = dbox.Copy("/a.txt", "/dir")
+	if !errors.Is(err, ErrConflict) || !errors.As(err, &api_err) || api_err.Path != "/dir" {
+		t.Errorf("Copy onto an existing folder = %v", err)
+	}
+
+	srv.Token = "other"
+	if _, err := dbox.GetAccount(); !errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrExpiredToken) {
+		t.Errorf("GetAccount with a bad token = %v", err)
+	}
+}
+
+func TestNewAPIError(t *testing.T) {
+	tests := []struct {
+		status int
+		header http.Header
+		body   string
+		kind   error
+		retry  time.Duration
+	}{
+		{409, nil, `{"error_summary": "path/insufficient_space/..", "error": {".tag": "path", "path": {".tag": "insufficient_space"}}}`, ErrInsufficientSpace, 0},
+		{401, nil, `{"error_summary": "expired_access_token/..", "error": {".tag": "expired_access_token"}}`, ErrExpiredToken, 0},
+		{429, http.Header{"Retry-After": {"7"}}, `{"error_summary": "too_many_requests/..", "error": {"reason": {".tag": "too_many_requests"}, "retry_after": 7}}`, ErrRateLimited, 7 * time.Second},
+		{400, nil, `Error in call to API function "files/get_metadata": bad path`, ErrBadRequest, 0},
+		{503, http.Header{"Retry-After": {"2"}}, `Service Unavailable`, ErrServer, 2 * time.Second},
+		{403, nil, `{"error_summary": "invalid_account_type/..", "error": {".tag": "invalid_account_type"}}`, ErrForbidden, 0},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		for key, values := range test.header {
+			rec.Header()[key] = values
+		}
+		rec.WriteHeader(test.status)
+		rec.WriteString(test.body)
+		resp := rec.Result()
+		resp.Request = httptest.NewRequest("POST", "/2/files/get_metadata", nil)
+
+		err := newAPIError(resp)
+		var api_err *APIError
+		if !errors.Is(err, test.kind) || !errors.As(err, &api_err) {
+			t.Errorf("%d %s: got %v, want %v", test.status, test.body, err, test.kind)
+			continue
+		}
+		if api_err.RetryAfter != test.retry || api_err.Endpoint != "files/get_metadata" {
+			t.Errorf("%d: RetryAfter = %v, Endpoint = %q", test.status, api_err.RetryAfter, api_err.Endpoint)
+		}
+	}
+}
@@ -22,8 +22,9 @@ func getWidth() uint {
 		uintptr(syscall.TIOCGWINSZ),
 		uintptr(unsafe.Pointer(ws)))
 
-	if int(retCode) == -1 {
-		panic(errno)
+	// Not a terminal, Format falls back to 80 columns
+	if int(retCode) == -1 || errno != 0 {
+		return 0
 	}
 	return uint(ws.Col)
 }
@@ -133,3 +134,17 @@ func combineStr(left string, sep string, right string) string {
 	}
 	return strings.Join(left_lines, sep)
 }
+
+// FormatSize formats a number of bytes for people, e.g. "1.5 MB".
+func FormatSize(bytes int64) string {
+	if bytes < 1000 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	size := float64(bytes)
+	unit := 0
+	for size >= 999.95 && unit < 5 {
+		size /= 1000
+		unit++
+	}
+	return fmt.Sprintf("%.1f %cB", size, " kMGTP"[unit])
+}
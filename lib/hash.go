@@ -0,0 +1,158 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// kHashBlockSize is the block size of the Dropbox content hash.
+const kHashBlockSize = 4 * 1024 * 1024
+
+// contentHash computes the Dropbox content_hash: the sha256 of the
+// concatenated sha256 sums of every 4 MiB block of the data.
+type contentHash struct {
+	overall hash.Hash
+	block   hash.Hash
+	n       int // bytes written to block
+}
+
+// NewContentHash returns a hash.Hash computing the content_hash that
+// Dropbox reports in file metadata, hex encode its Sum to compare them.
+func NewContentHash() hash.Hash {
+	return &contentHash{overall: sha256.New(), block: sha256.New()}
+}
+
+func (h *contentHash) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := len(p)
+		if rest := kHashBlockSize - h.n; n > rest {
+			n = rest
+		}
+		h.block.Write(p[:n])
+		h.n += n
+		p = p[n:]
+		if h.n == kHashBlockSize {
+			h.overall.Write(h.block.Sum(nil))
+			h.block.Reset()
+			h.n = 0
+		}
+	}
+	return written, nil
+}
+
+// Sum appends the hash to b without changing the state.
+func (h *contentHash) Sum(b []byte) []byte {
+	overall := h.overall
+	if h.n > 0 {
+		// Hash a copy of the state with the partial last block added
+		state, _ := h.overall.(encoding.BinaryMarshaler).MarshalBinary()
+		overall = sha256.New()
+		overall.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+		overall.Write(h.block.Sum(nil))
+	}
+	return overall.Sum(b)
+}
+
+func (h *contentHash) Reset() {
+	h.overall.Reset()
+	h.block.Reset()
+	h.n = 0
+}
+
+func (h *contentHash) Size() int {
+	return sha256.Size
+}
+
+func (h *contentHash) BlockSize() int {
+	return kHashBlockSize
+}
+
+// FileContentHash returns the hex content_hash of a local file.
+func FileContentHash(local_path string) (string, error) {
+	f, err := os.Open(local_path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := NewContentHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkHash compares the hash of the data sent or received for path
+// with the content_hash of its metadata.
+func checkHash(h hash.Hash, metadata Metadata, path string) error {
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != metadata.ContentHash {
+		return fmt.Errorf("%w: %s: got %s, expected %s", ErrHashMismatch, path, sum, metadata.ContentHash)
+	}
+	return nil
+}
+
+// hashReader hashes what is read from r. Seeking back to the start
+// resets the hash, so a retried request hashes its body again.
+type hashReader struct {
+	r io.ReadSeeker
+	h hash.Hash
+}
+
+func (r *hashReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	return n, err
+}
+
+func (r *hashReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.r.Seek(offset, whence)
+	if err == nil && pos == 0 {
+		r.h.Reset()
+	}
+	return pos, err
+}
+
+// contextReader reads from r until ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// Verify checks that a local file has the content of a remote file by
+// comparing content hashes, nothing is downloaded. It returns an error
+// wrapping ErrHashMismatch when they differ.
+func (dbox *Dropbox) Verify(remote_path string, local_path string) error {
+	return dbox.VerifyContext(context.Background(), remote_path, local_path)
+}
+
+// VerifyContext is Verify with a context.
+func (dbox *Dropbox) VerifyContext(ctx context.Context, remote_path string, local_path string) error {
+	metadata, err := dbox.StatContext(ctx, remote_path)
+	if err != nil {
+		return err
+	}
+	if metadata.IsDir {
+		return fmt.Errorf("dropbox: %s: is a folder", remote_path)
+	}
+	sum, err := FileContentHash(local_path)
+	if err != nil {
+		return err
+	}
+	if sum != metadata.ContentHash {
+		return fmt.Errorf("%w: %s: local %s, remote %s", ErrHashMismatch, local_path, sum, metadata.ContentHash)
+	}
+	return nil
+}
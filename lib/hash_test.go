@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/isyangban/gdbox/lib/dboxtest"
+)
+
+func TestContentHash(t *testing.T) {
+	data := make([]byte, 2*kHashBlockSize+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, size := range []int{0, 1, kHashBlockSize, kHashBlockSize + 1, len(data)} {
+		h := NewContentHash()
+		// Writes of odd sizes cross block boundaries
+		for rest := data[:size]; len(rest) > 0; {
+			n := 1000003
+			if n > len(rest) {
+				n = len(rest)
+			}
+			h.Write(rest[:n])
+			rest = rest[n:]
+		}
+		got := hex.EncodeToString(h.Sum(nil))
+		if want := dboxtest.ContentHash(data[:size]); got != want {
+			t.Errorf("%d bytes: hash %s, want %s", size, got, want)
+		}
+		if again := hex.EncodeToString(h.Sum(nil)); again != got {
+			t.Errorf("%d bytes: Sum changed the state", size)
+		}
+	}
+}
+
+func TestTransferVerification(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	defer func(limit int64) { kDboxConst.DirectUploadSizeLimit = limit }(kDboxConst.DirectUploadSizeLimit)
+	kDboxConst.DirectUploadSizeLimit = 10
+	dir := t.TempDir()
+	small := []byte("small")
+	large := bytes.Repeat([]byte("0123456789"), 3)
+	ioutil.WriteFile(filepath.Join(dir, "small"), small, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "large"), large, 0644)
+
+	// A corrupted upload is detected and sent again
+	srv.CorruptNext("files/upload", 1)
+	if err := dbox.Upload("/small", filepath.Join(dir, "small")); err != nil {
+		t.Fatal(err)
+	}
+	srv.CorruptNext("files/upload_session/append_v2", 1)
+	if err := dbox.Upload("/large", filepath.Join(dir, "large")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string][]byte{"/small": small, "/large": large} {
+		if got, _ := srv.File(name); !bytes.Equal(got, want) {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if n := srv.Requests("files/upload"); n != 2 {
+		t.Errorf("%d direct uploads, want 2", n)
+	}
+
+	srv.CorruptNext("files/download", 1)
+	if err := dbox.Download("/large", filepath.Join(dir, "copy")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "copy")); !bytes.Equal(got, large) {
+		t.Errorf("download = %q", got)
+	}
+
+	// Corruption on every try is a hard error
+	srv.CorruptNext("files/download", dbox.MaxTries)
+	if err := dbox.Download("/large", filepath.Join(dir, "bad")); !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("Download = %v, want ErrHashMismatch", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 3 {
+		t.Errorf("%d files, the failed download left some behind", len(files))
+	}
+}
+
+func TestVerify(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/a.txt", []byte("hello"))
+	local := filepath.Join(t.TempDir(), "a.txt")
+
+	ioutil.WriteFile(local, []byte("hello"), 0644)
+	if err := dbox.Verify("/a.txt", local); err != nil {
+		t.Errorf("Verify of an equal copy = %v", err)
+	}
+	ioutil.WriteFile(local, []byte("HELLO"), 0644)
+	if err := dbox.Verify("/a.txt", local); !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("Verify of a changed copy = %v", err)
+	}
+	if err := dbox.Verify("/missing", local); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Verify of a missing file = %v", err)
+	}
+	if n := srv.Requests("files/download"); n != 0 {
+		t.Errorf("Verify downloaded %d times", n)
+	}
+	// A folder is not listed to find out it is one
+	srv.PutFile("/dir/b.txt", []byte("b"))
+	if err := dbox.Verify("/dir", local); err == nil {
+		t.Error("Verify of a folder succeeded")
+	}
+	if n := srv.Requests("files/list_folder"); n != 0 {
+		t.Errorf("Verify listed %d folders", n)
+	}
+}
+
+func TestContextReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	data := bytes.NewReader(make([]byte, 1<<20))
+	r := contextReader{ctx, data}
+	if _, err := r.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if n, err := ioutil.ReadAll(r); len(n) != 0 || !errors.Is(err, context.Canceled) {
+		t.Errorf("read %d bytes after cancel, %v", len(n), err)
+	}
+	if data.Len() != 1<<20-1024 {
+		t.Errorf("%d bytes left unread, want all but the first read", data.Len())
+	}
+}
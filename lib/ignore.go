@@ -0,0 +1,275 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// IgnoreFileName is the ignore file read in every local folder.
+const IgnoreFileName = ".gdboxignore"
+
+// Rule is a gitignore style pattern: "*" and "?" match within a path
+// element, "**" across elements, a trailing "/" only matches folders, a
+// "/" anywhere else anchors the pattern to the folder of the rule, and
+// a leading "!" keeps what earlier rules ignore. Matching ignores case,
+// like Dropbox paths.
+type Rule struct {
+	Pattern string // as written
+	Source  string // ignore file, "config", "-exclude" or "-include"
+	Line    int    // in Source, 0 for flags
+
+	negate   bool
+	dir_only bool
+	base     string // folder of the ignore file, relative to the root
+	re       *regexp.Regexp
+}
+
+// String tells where the rule comes from, like git check-ignore -v.
+func (r *Rule) String() string {
+	if r.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", r.Source, r.Line, r.Pattern)
+	}
+	return r.Source + ": " + r.Pattern
+}
+
+// Negated reports whether the rule keeps files instead of ignoring them.
+func (r *Rule) Negated() bool {
+	return r.negate
+}
+
+// parseRule parses a line of an ignore list, false for blank lines and
+// comments.
+func parseRule(line string, source string, line_no int) (Rule, bool) {
+	rule := Rule{Pattern: line, Source: source, Line: line_no}
+	p := strings.TrimRight(line, "\r")
+	for strings.HasSuffix(p, " ") && !strings.HasSuffix(p, "\\ ") {
+		p = p[:len(p)-1]
+	}
+	rule.Pattern = p
+	if p == "" || p[0] == '#' {
+		return rule, false
+	}
+	if p[0] == '!' {
+		rule.negate, p = true, p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		rule.dir_only, p = true, strings.TrimRight(p, "/")
+	}
+	if p == "" {
+		return rule, false
+	}
+	prefix := "(?:.*/)?"
+	if strings.Contains(p, "/") {
+		prefix, p = "", strings.TrimPrefix(p, "/")
+	}
+	rule.re = regexp.MustCompile("(?i)^" + prefix + globRegexp(p) + "$")
+	return rule, true
+}
+
+// globRegexp translates a glob to a regular expression. A "[" without
+// its "]" is taken literally.
+func globRegexp(glob string) string {
+	var re strings.Builder
+	for i := 0; i < len(glob); i++ {
+		at_start := i == 0 || glob[i-1] == '/'
+		switch c := glob[i]; {
+		case at_start && strings.HasPrefix(glob[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case at_start && glob[i:] == "**":
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := classEnd(glob, i)
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+			re.WriteString("[")
+			class := glob[i+1 : end]
+			if class[0] == '!' || class[0] == '^' {
+				re.WriteString("^/")
+				class = class[1:]
+			}
+			for j := 0; j < len(class); j++ {
+				if class[j] != '-' && class[j] < 0x80 && !isAlnum(class[j]) {
+					re.WriteByte('\\')
+				}
+				re.WriteByte(class[j])
+			}
+			re.WriteString("]")
+			i = end
+		case c == '\\' && i+1 < len(glob):
+			i++
+			re.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return re.String()
+}
+
+// classEnd returns the index of the "]" closing the class at start,
+// -1 if there is none.
+func classEnd(glob string, start int) int {
+	i := start + 1
+	if i < len(glob) && (glob[i] == '!' || glob[i] == '^') {
+		i++
+	}
+	if i < len(glob) && glob[i] == ']' {
+		i++
+	}
+	if end := strings.IndexByte(glob[i:], ']'); end >= 0 {
+		return i + end
+	}
+	return -1
+}
+
+func isAlnum(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// match reports whether the rule matches rel, relative to the root.
+func (r *Rule) match(rel string, is_dir bool) bool {
+	if r.dir_only && !is_dir {
+		return false
+	}
+	if r.base != "" {
+		n := len(r.base)
+		if len(rel) <= n || rel[n] != '/' || !strings.EqualFold(rel[:n], r.base) {
+			return false
+		}
+		rel = rel[n+1:]
+	}
+	return r.re.MatchString(rel)
+}
+
+// Filter decides which files are transferred. Rules are checked from the
+// global list of the config, through the ignore files of the folders
+// above a file from the outermost one, to the -exclude and -include
+// flags, and the last rule matching decides. A nil Filter ignores
+// nothing.
+type Filter struct {
+	global []Rule
+	flags  []Rule
+
+	mu    sync.Mutex
+	files map[string][]Rule // rules of the ignore file of each local folder
+}
+
+// NewFilter returns a filter without rules, which still reads ignore
+// files.
+func NewFilter() *Filter {
+	return &Filter{files: make(map[string][]Rule)}
+}
+
+// Global adds the ignore list of the config.
+func (f *Filter) Global(patterns ...string) {
+	for _, pattern := range patterns {
+		if rule, ok := parseRule(pattern, "config", len(f.global)+1); ok {
+			f.global = append(f.global, rule)
+		}
+	}
+}
+
+// Exclude ignores what pattern matches, over any ignore file.
+func (f *Filter) Exclude(pattern string) {
+	if rule, ok := parseRule(pattern, "-exclude", 0); ok {
+		f.flags = append(f.flags, rule)
+	}
+}
+
+// Include keeps what pattern matches, over any ignore file. Files in an
+// ignored folder stay ignored, as the folder is not looked into.
+func (f *Filter) Include(pattern string) {
+	if rule, ok := parseRule(pattern, "-include", 0); ok {
+		rule.negate = true
+		f.flags = append(f.flags, rule)
+	}
+}
+
+// Match reports whether rel, a slash separated path relative to the
+// local folder root, is ignored, and the rule that decided, nil when no
+// rule matched. Anything in an ignored folder is ignored. Ignore files
+// are read from root and the folders under it, root "" has none.
+func (f *Filter) Match(root string, rel string, is_dir bool) (bool, *Rule) {
+	elems := strings.Split(rel, "/")
+	for i := 1; i < len(elems); i++ {
+		if ignored, rule := f.match(root, strings.Join(elems[:i], "/"), true); ignored {
+			return true, rule
+		}
+	}
+	return f.match(root, rel, is_dir)
+}
+
+// Ignores is Match without the rule.
+func (f *Filter) Ignores(root string, rel string, is_dir bool) bool {
+	ignored, _ := f.Match(root, rel, is_dir)
+	return ignored
+}
+
+// match is Match for a path whose folders are known not to be ignored.
+func (f *Filter) match(root string, rel string, is_dir bool) (bool, *Rule) {
+	if f == nil || rel == "." || rel == "" {
+		return false, nil
+	}
+	rules := [][]Rule{f.global}
+	if root != "" {
+		var dirs []string
+		for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+			dirs = append(dirs, dir)
+		}
+		rules = append(rules, f.ignoreFile(root, "."))
+		for i := len(dirs) - 1; i >= 0; i-- {
+			rules = append(rules, f.ignoreFile(root, dirs[i]))
+		}
+	}
+	rules = append(rules, f.flags)
+	for i := len(rules) - 1; i >= 0; i-- {
+		for j := len(rules[i]) - 1; j >= 0; j-- {
+			if rule := &rules[i][j]; rule.match(rel, is_dir) {
+				return !rule.negate, rule
+			}
+		}
+	}
+	return false, nil
+}
+
+// ignoreFile returns the rules of the ignore file in the folder dir
+// under root, read once.
+func (f *Filter) ignoreFile(root string, dir string) []Rule {
+	file_path := filepath.Join(root, filepath.FromSlash(dir), IgnoreFileName)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if rules, ok := f.files[file_path]; ok {
+		return rules
+	}
+	if f.files == nil {
+		f.files = make(map[string][]Rule)
+	}
+	var rules []Rule
+	if file, err := os.Open(file_path); err == nil {
+		scanner := bufio.NewScanner(file)
+		for line_no := 1; scanner.Scan(); line_no++ {
+			if rule, ok := parseRule(scanner.Text(), file_path, line_no); ok {
+				if dir != "." {
+					rule.base = dir
+				}
+				rules = append(rules, rule)
+			}
+		}
+		file.Close()
+	}
+	f.files[file_path] = rules
+	return rules
+}
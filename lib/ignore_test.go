@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRule(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		is_dir  bool
+		want    bool
+	}{
+		{"*.swp", "a.swp", false, true},
+		{"*.swp", "dir/.a.swp", false, true},
+		{"*.swp", "a.swp.txt", false, false},
+		{"node_modules/", "web/node_modules", true, true},
+		{"node_modules/", "web/node_modules", false, false},
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"doc/*.txt", "doc/a.txt", false, true},
+		{"doc/*.txt", "doc/sub/a.txt", false, false},
+		{"doc/**/*.txt", "doc/sub/deep/a.txt", false, true},
+		{"doc/**/*.txt", "doc/a.txt", false, true},
+		{"**/cache", "a/b/cache", true, true},
+		{"logs/**", "logs/a/b.log", false, true},
+		{"logs/**", "logs", true, false},
+		{"file?.[ch]", "file1.c", false, true},
+		{"file?.[!ch]", "file1.c", false, false},
+		{"[abc", "[abc", false, true},
+		{`\#notes`, "#notes", false, true},
+		{"*.JPG", "photo.jpg", false, true},
+		{"trailing   ", "trailing", false, true},
+	}
+	for _, test := range tests {
+		rule, ok := parseRule(test.pattern, "test", 1)
+		if !ok {
+			t.Errorf("%q was not parsed", test.pattern)
+			continue
+		}
+		if got := rule.match(test.path, test.is_dir); got != test.want {
+			t.Errorf("%q matches %q = %v, want %v", test.pattern, test.path, got, test.want)
+		}
+	}
+	for _, line := range []string{"", "   ", "# comment", "!", "/"} {
+		if _, ok := parseRule(line, "test", 1); ok {
+			t.Errorf("%q is a rule", line)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "web", "node_modules"), 0755)
+	ioutil.WriteFile(filepath.Join(root, IgnoreFileName), []byte("*.log\nbuild/\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "web", IgnoreFileName), []byte("!keep.log\n/local.txt\n"), 0644)
+
+	filter := NewFilter()
+	filter.Global("node_modules/", "*.tmp")
+	filter.Exclude("secret.txt")
+	filter.Include("important.tmp")
+	tests := []struct {
+		path   string
+		want   bool
+		source string
+	}{
+		{"a.txt", false, ""},
+		{"a.log", true, filepath.Join(root, IgnoreFileName)},
+		{"web/keep.log", false, filepath.Join(root, "web", IgnoreFileName)},
+		{"keep.log", true, filepath.Join(root, IgnoreFileName)},
+		{"web/local.txt", true, filepath.Join(root, "web", IgnoreFileName)},
+		{"local.txt", false, ""},
+		{"web/node_modules/x/index.js", true, "config"},
+		{"build/out/a.txt", true, filepath.Join(root, IgnoreFileName)},
+		{"web/secret.txt", true, "-exclude"},
+		{"a.tmp", true, "config"},
+		{"important.tmp", false, "-include"},
+	}
+	for _, test := range tests {
+		ignored, rule := filter.Match(root, test.path, false)
+		source := ""
+		if rule != nil {
+			source = rule.Source
+		}
+		if ignored != test.want || source != test.source {
+			t.Errorf("Match(%s) = %v by %q, want %v by %q", test.path, ignored, source, test.want, test.source)
+		}
+	}
+	// Without a root only the config and flags apply
+	if filter.Ignores("", "a.log", false) || !filter.Ignores("", "a.tmp", false) {
+		t.Error("ignore files were read without a root")
+	}
+	var nil_filter *Filter
+	if nil_filter.Ignores(root, "a.log", false) {
+		t.Error("a nil filter ignored a file")
+	}
+}
+
+func TestFilteredTransfers(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	local := t.TempDir()
+	for _, name := range []string{"a.txt", "a.swp", ".git/config", "src/b.txt", "src/tmp/c.txt"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(local, name)), 0755)
+		ioutil.WriteFile(filepath.Join(local, name), []byte(name), 0644)
+	}
+	ioutil.WriteFile(filepath.Join(local, "src", IgnoreFileName), []byte("tmp/\n"), 0644)
+	dbox.Filter = NewFilter()
+	dbox.Filter.Global(".git/", "*.swp")
+
+	if err := dbox.Upload("/up", local); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"a.txt": true, "src/b.txt": true, "src/" + IgnoreFileName: true,
+		"a.swp": false, ".git/config": false, "src/tmp/c.txt": false} {
+		if srv.Exists("/up/"+name) != want {
+			t.Errorf("uploaded /up/%s = %v, want %v", name, !want, want)
+		}
+	}
+
+	// Ignored files are left alone on both sides by sync
+	srv.PutFile("/s/remote.swp", []byte("remote"))
+	state, _ := LoadSyncState(filepath.Join(t.TempDir(), "state.json"))
+	if err := dbox.Sync(local, "/s", state); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Exists("/s/a.swp") || srv.Exists("/s/src/tmp/c.txt") || !srv.Exists("/s/src/b.txt") {
+		t.Errorf("sync uploaded %v", srv.Paths())
+	}
+	if _, err := os.Stat(filepath.Join(local, "remote.swp")); !os.IsNotExist(err) {
+		t.Error("sync downloaded an ignored file")
+	}
+}
@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Upload sessions can be used for a week after they were started,
+// leave some margin so a resumed upload can still finish.
+const (
+	kSessionLifetime = 7 * 24 * time.Hour
+	kSessionMargin   = time.Hour
+)
+
+// chunkedFile is the state of a chunked upload. It is journaled after
+// every chunk so a later run can resume the upload.
+type chunkedFile struct {
+	UploadId   string    `json:"session_id"`
+	Offset     int64     `json:"offset"`
+	Expires    time.Time `json:"expires"`
+	RemotePath string    `json:"remote_path"`
+	LocalPath  string    `json:"local_path"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mtime"`
+	Inode      uint64    `json:"inode"`
+	// Concurrent sessions get their chunks in any order, Done holds
+	// the offsets of the chunks already appended.
+	Concurrent bool    `json:"concurrent,omitempty"`
+	ChunkSize  int64   `json:"chunk_size,omitempty"`
+	Done       []int64 `json:"done,omitempty"`
+}
+
+func newChunkedFile(remote_path string, local_path string, stat os.FileInfo) *chunkedFile {
+	abs, err := filepath.Abs(local_path)
+	if err != nil {
+		abs = local_path
+	}
+	chunked_file := &chunkedFile{
+		RemotePath: remote_path,
+		LocalPath:  abs,
+		Size:       stat.Size(),
+		ModTime:    stat.ModTime(),
+	}
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		chunked_file.Inode = uint64(sys.Ino)
+	}
+	return chunked_file
+}
+
+// sameFile reports whether both records describe the same upload of the
+// same, unmodified local file.
+func (c *chunkedFile) sameFile(other *chunkedFile) bool {
+	return c.RemotePath == other.RemotePath && c.LocalPath == other.LocalPath &&
+		c.Size == other.Size && c.ModTime.Equal(other.ModTime) && c.Inode == other.Inode
+}
+
+// UploadJournal keeps the state of chunked uploads in Dir, one json file
+// per local file and remote path. A nil journal records nothing.
+type UploadJournal struct {
+	Dir string
+}
+
+func (j *UploadJournal) file(c *chunkedFile) string {
+	sum := sha256.Sum256([]byte(c.LocalPath + "\x00" + c.RemotePath))
+	return filepath.Join(j.Dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// load returns the journaled upload of the same file if it can still be
+// resumed.
+func (j *UploadJournal) load(c *chunkedFile) (*chunkedFile, bool) {
+	if j == nil {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(j.file(c))
+	if err != nil {
+		return nil, false
+	}
+	journaled := new(chunkedFile)
+	if json.Unmarshal(data, journaled) != nil || journaled.UploadId == "" || !journaled.sameFile(c) {
+		return nil, false
+	}
+	if time.Now().Add(kSessionMargin).After(journaled.Expires) {
+		os.Remove(j.file(c))
+		return nil, false
+	}
+	return journaled, true
+}
+
+func (j *UploadJournal) save(c *chunkedFile) error {
+	if j == nil {
+		return nil
+	}
+	if err := os.MkdirAll(j.Dir, 0700); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(c)
+	tmp := j.file(c) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.file(c))
+}
+
+func (j *UploadJournal) remove(c *chunkedFile) {
+	if j != nil {
+		os.Remove(j.file(c))
+	}
+}
+
+// Clear removes every journaled upload.
+func (j *UploadJournal) Clear() error {
+	if j == nil {
+		return nil
+	}
+	return os.RemoveAll(j.Dir)
+}
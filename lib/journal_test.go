@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadResume(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	defer func(limit int64) { kDboxConst.DirectUploadSizeLimit = limit }(kDboxConst.DirectUploadSizeLimit)
+	kDboxConst.DirectUploadSizeLimit = 10
+	dbox.Journal = &UploadJournal{Dir: filepath.Join(t.TempDir(), "uploads")}
+
+	data := bytes.Repeat([]byte("0123456789"), 5)
+	local := filepath.Join(t.TempDir(), "big.bin")
+	ioutil.WriteFile(local, data, 0644)
+
+	// The first chunk starts the session, then the connection drops
+	srv.FailNext("files/upload_session/append_v2", 500, dbox.MaxTries)
+	if err := dbox.Upload("/big.bin", local); err == nil {
+		t.Fatal("upload succeeded on a failing server")
+	}
+	if srv.Exists("/big.bin") {
+		t.Fatal("interrupted upload was committed")
+	}
+	appends := srv.Requests("files/upload_session/append_v2")
+
+	if err := dbox.UploadResume("/big.bin", local); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := srv.File("/big.bin"); !bytes.Equal(got, data) {
+		t.Errorf("resumed upload = %q", got)
+	}
+	if srv.Requests("files/upload_session/start") != 1 {
+		t.Error("resumed upload started a new session")
+	}
+	if n := srv.Requests("files/upload_session/append_v2") - appends; n != 4 {
+		t.Errorf("resumed upload sent %d chunks, want 4", n)
+	}
+	if files, _ := ioutil.ReadDir(dbox.Journal.Dir); len(files) != 0 {
+		t.Errorf("%d journal entries left after the upload", len(files))
+	}
+}
+
+func TestConcurrentUploadResume(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	defer func(c dboxConst) { kDboxConst = c }(kDboxConst)
+	kDboxConst.DirectUploadSizeLimit, kDboxConst.ChunkAlign = 10, 10
+	srv.ChunkAlign = 10
+	dbox.ChunkSize, dbox.ChunkWorkers, dbox.MaxTries = 10, 2, 1
+	dbox.Journal = &UploadJournal{Dir: filepath.Join(t.TempDir(), "uploads")}
+
+	data := bytes.Repeat([]byte("0123456789"), 5)
+	local := filepath.Join(t.TempDir(), "big.bin")
+	ioutil.WriteFile(local, data, 0644)
+
+	// One of the first four chunks fails, the last one is held back
+	srv.FailNext("files/upload_session/append_v2", 500, 1)
+	if err := dbox.Upload("/big.bin", local); err == nil {
+		t.Fatal("upload succeeded on a failing server")
+	}
+	if n := srv.Requests("files/upload_session/append_v2"); n != 4 {
+		t.Fatalf("%d appends before the failure, want 4", n)
+	}
+
+	if err := dbox.UploadResume("/big.bin", local); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := srv.File("/big.bin"); !bytes.Equal(got, data) {
+		t.Errorf("resumed upload = %q", got)
+	}
+	if srv.Requests("files/upload_session/start") != 1 {
+		t.Error("resumed upload started a new session")
+	}
+	if n := srv.Requests("files/upload_session/append_v2"); n != 6 {
+		t.Errorf("%d appends in total, want 6", n)
+	}
+}
+
+func TestUploadJournal(t *testing.T) {
+	journal := &UploadJournal{Dir: t.TempDir()}
+	local := filepath.Join(t.TempDir(), "f")
+	ioutil.WriteFile(local, []byte("data"), 0644)
+	stat, _ := os.Stat(local)
+
+	c := newChunkedFile("/f", local, stat)
+	c.UploadId, c.Offset, c.Expires = "session", 2, time.Now().Add(kSessionLifetime)
+	if err := journal.save(c); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := journal.load(newChunkedFile("/f", local, stat)); !ok || got.Offset != 2 {
+		t.Errorf("load = %+v, %v", got, ok)
+	}
+	if _, ok := journal.load(newChunkedFile("/other", local, stat)); ok {
+		t.Error("loaded the journal of another remote path")
+	}
+
+	// A modified file is not resumed
+	time.Sleep(10 * time.Millisecond)
+	ioutil.WriteFile(local, []byte("changed"), 0644)
+	stat, _ = os.Stat(local)
+	if _, ok := journal.load(newChunkedFile("/f", local, stat)); ok {
+		t.Error("loaded the journal of a modified file")
+	}
+
+	// Nor is an expired session
+	c = newChunkedFile("/f", local, stat)
+	c.UploadId, c.Expires = "session", time.Now()
+	journal.save(c)
+	if _, ok := journal.load(c); ok {
+		t.Error("loaded an expired session")
+	}
+	var nil_journal *UploadJournal
+	if _, ok := nil_journal.load(c); ok || nil_journal.save(c) != nil || nil_journal.Clear() != nil {
+		t.Error("nil journal is not a no-op")
+	}
+}
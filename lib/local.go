@@ -0,0 +1,47 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WalkFiles calls fn for every file under root, in lexical order, or for
+// root itself when it is a file. Folders are read one at a time, so any
+// number of files is walked in bounded memory. Files and folders filter
+// ignores are skipped, as are the partial and temporary files of
+// downloads in progress; rel is the slash separated path of a file
+// relative to root, the base name for root itself. Walking stops at the
+// first error, which is returned.
+func WalkFiles(root string, filter *Filter, fn func(file string, rel string) error) error {
+	stat, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fn(root, filepath.Base(root))
+	}
+	return filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, file)
+		rel = filepath.ToSlash(rel)
+		if ignored, _ := filter.match(root, rel, info.IsDir()); ignored {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			// Links to files are uploaded as the file
+			if info, err = os.Stat(file); err != nil || info.IsDir() {
+				return nil
+			}
+		}
+		// Partial and temporary files of downloads are left out
+		if !info.Mode().IsRegular() || isTempName(filepath.Base(file)) {
+			return nil
+		}
+		return fn(file, rel)
+	})
+}
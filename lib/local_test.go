@@ -0,0 +1,46 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWalkFiles(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "sub", "skip"), 0755)
+	for i := 0; i < 150; i++ {
+		ioutil.WriteFile(filepath.Join(root, "sub", fmt.Sprintf("%03d.txt", i)), nil, 0644)
+	}
+	ioutil.WriteFile(filepath.Join(root, "a.txt"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(root, "sub", "skip", "b.txt"), nil, 0644)
+	// Left by downloads in progress
+	for _, name := range []string{"c.txt" + kPartialSuffix, "c.txt" + kPartialSuffix + ".json", ".c.txt.gdbox-123"} {
+		ioutil.WriteFile(filepath.Join(root, "sub", name), nil, 0644)
+	}
+	filter := NewFilter()
+	filter.Exclude("skip/")
+
+	var rels []string
+	err := WalkFiles(root, filter, func(file string, rel string) error {
+		if file != filepath.Join(root, filepath.FromSlash(rel)) {
+			t.Errorf("file %s is not at %s", file, rel)
+		}
+		rels = append(rels, rel)
+		return nil
+	})
+	if err != nil || len(rels) != 151 || rels[0] != "a.txt" || rels[150] != "sub/149.txt" {
+		t.Errorf("WalkFiles = %v, walked %d files: %v", err, len(rels), rels)
+	}
+
+	var single []string
+	WalkFiles(filepath.Join(root, "a.txt"), filter, func(file string, rel string) error {
+		single = append(single, rel)
+		return nil
+	})
+	if len(single) != 1 || single[0] != "a.txt" {
+		t.Errorf("walk of a file = %v", single)
+	}
+}
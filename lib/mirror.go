@@ -0,0 +1,275 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MirrorOp is a step of a mirror. "create" and "update" copy a file, or
+// make a folder, from the source; "delete" removes a file or a whole
+// folder from the destination. Size is the size of the file copied or
+// deleted; for a folder that is deleted, the size of the files in it,
+// otherwise 0.
+type MirrorOp struct {
+	Op    string
+	Path  string // relative to the mirrored folders
+	Size  int64
+	IsDir bool
+
+	rev string // of the remote file to download
+}
+
+// MirrorPlan is what it takes to make one folder an exact copy of
+// another, see PlanMirror.
+type MirrorPlan struct {
+	Upload bool // local to remote, otherwise remote to local
+	Local  string
+	Remote string
+	Ops    []MirrorOp
+}
+
+// PlanMirror compares local_path and remote_path and returns the steps
+// that make the destination, remote_path when upload is set, an exact
+// copy of the source. Files with the same size and content hash on both
+// sides are left alone, files and folders only in the destination are
+// deleted. Files ignored by Filter are neither copied nor deleted, so a
+// folder holding some is kept and only its other content deleted.
+// Nothing is changed until the plan is passed to Mirror.
+func (dbox *Dropbox) PlanMirror(local_path string, remote_path string, upload bool) (*MirrorPlan, error) {
+	return dbox.PlanMirrorContext(context.Background(), local_path, remote_path, upload)
+}
+
+// PlanMirrorContext is PlanMirror with a context.
+func (dbox *Dropbox) PlanMirrorContext(ctx context.Context, local_path string, remote_path string, upload bool) (*MirrorPlan, error) {
+	local_root, err := filepath.Abs(local_path)
+	if err != nil {
+		return nil, err
+	}
+	plan := &MirrorPlan{Upload: upload, Local: local_root, Remote: apiPath(remote_path)}
+	local_kept, remote_kept := make(map[string]bool), make(map[string]bool)
+	locals, local_dirs, err := dbox.scanLocal(local_root, local_kept)
+	if os.IsNotExist(err) && !upload {
+		// Downloading into a new folder
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// An exact copy of a missing folder would delete everything
+	remotes, remote_dirs, err := dbox.scanRemote(ctx, plan.Remote, local_root, !upload, remote_kept)
+	if err != nil {
+		return nil, err
+	}
+
+	local, remote := newMirrorSide(local_dirs), newMirrorSide(remote_dirs)
+	for key, file := range locals {
+		local.files[key], local.names[key] = file.Size, file.Path
+	}
+	for key, file := range remotes {
+		remote.files[key], remote.names[key] = file.Bytes, file.Path
+	}
+	src, dst, kept := local, remote, remote_kept
+	if !upload {
+		src, dst, kept = remote, local, local_kept
+	}
+
+	var deletes, copies []MirrorOp
+	// This includes folders where the source has a file. Folders with
+	// ignored files in them stay, only their other content is deleted.
+	deleted := make(map[string]bool)
+	for key, dir := range dst.dirs {
+		if _, ok := src.dirs[key]; !ok && !kept[key] {
+			deleted[key] = true
+			deletes = append(deletes, MirrorOp{Op: "delete", Path: dir, IsDir: true})
+		}
+	}
+	for key, size := range dst.files {
+		if _, ok := src.files[key]; !ok {
+			deletes = append(deletes, MirrorOp{Op: "delete", Path: dst.names[key], Size: size})
+		}
+	}
+	for key, size := range src.files {
+		op := MirrorOp{Op: "create", Path: src.names[key], Size: size, rev: remotes[key].Rev}
+		if dst_size, ok := dst.files[key]; ok {
+			same, err := plan.sameFile(locals[key], remotes[key], size == dst_size)
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				continue
+			}
+			op.Op = "update"
+		}
+		copies = append(copies, op)
+	}
+	// Folders with something in them are made by their content
+	parents := src.parents()
+	for key, dir := range src.dirs {
+		if _, ok := dst.dirs[key]; !ok && !parents[key] {
+			copies = append(copies, MirrorOp{Op: "create", Path: dir, IsDir: true})
+		}
+	}
+
+	// Deleting a folder deletes what is in it, which adds to its size
+	var dropped []MirrorOp
+	plan.Ops = deletes[:0]
+	for _, op := range deletes {
+		if underDeleted(strings.ToLower(op.Path), deleted) {
+			dropped = append(dropped, op)
+		} else {
+			plan.Ops = append(plan.Ops, op)
+		}
+	}
+	folders := make(map[string]int)
+	for i, op := range plan.Ops {
+		if op.IsDir {
+			folders[strings.ToLower(op.Path)] = i
+		}
+	}
+	for _, op := range dropped {
+		for dir := path.Dir(strings.ToLower(op.Path)); dir != "."; dir = path.Dir(dir) {
+			if i, ok := folders[dir]; ok {
+				plan.Ops[i].Size += op.Size
+				break
+			}
+		}
+	}
+	sortOps(plan.Ops)
+	sortOps(copies)
+	plan.Ops = append(plan.Ops, copies...)
+	return plan, nil
+}
+
+// sameFile compares the content hashes of a file on both sides, the
+// local file is only hashed when the sizes match.
+func (plan *MirrorPlan) sameFile(local localFile, remote Metadata, same_size bool) (bool, error) {
+	if !same_size {
+		return false, nil
+	}
+	sum, err := FileContentHash(filepath.Join(plan.Local, filepath.FromSlash(local.Path)))
+	return sum == remote.ContentHash, err
+}
+
+// mirrorSide is the files and folders on one side of a mirror, keyed by
+// lower case relative path.
+type mirrorSide struct {
+	files map[string]int64 // sizes
+	names map[string]string
+	dirs  map[string]string
+}
+
+func newMirrorSide(dirs map[string]string) *mirrorSide {
+	return &mirrorSide{files: make(map[string]int64), names: make(map[string]string), dirs: dirs}
+}
+
+// parents returns the folders that have a file or folder in them.
+func (side *mirrorSide) parents() map[string]bool {
+	parents := make(map[string]bool)
+	for key := range side.files {
+		markParents(parents, key)
+	}
+	for key := range side.dirs {
+		markParents(parents, key)
+	}
+	return parents
+}
+
+// markParents adds the parent folders of key to set, unless set is nil.
+func markParents(set map[string]bool, key string) {
+	if set == nil {
+		return
+	}
+	for dir := path.Dir(key); dir != "." && dir != "/" && !set[dir]; dir = path.Dir(dir) {
+		set[dir] = true
+	}
+}
+
+// underDeleted reports whether a parent folder of key is deleted.
+func underDeleted(key string, deleted map[string]bool) bool {
+	for dir := path.Dir(key); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if deleted[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+func sortOps(ops []MirrorOp) {
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Path < ops[j].Path })
+}
+
+// Mirror runs the steps of plan on Workers goroutines and reports them
+// to Report. Deletions go first, so a file can replace a folder.
+func (dbox *Dropbox) Mirror(plan *MirrorPlan) error {
+	return dbox.MirrorContext(context.Background(), plan)
+}
+
+// MirrorContext is Mirror with a context.
+func (dbox *Dropbox) MirrorContext(ctx context.Context, plan *MirrorPlan) error {
+	var deletes, copies []Transfer
+	for _, op := range plan.Ops {
+		op := op
+		transfer := Transfer{Name: op.Op + " " + op.Path, Run: func(ctx context.Context) (string, error) {
+			return "", dbox.mirrorStep(ctx, plan, op)
+		}}
+		if op.Op == "delete" {
+			deletes = append(deletes, transfer)
+		} else {
+			copies = append(copies, transfer)
+		}
+	}
+	err := joinTransferErrors(len(plan.Ops),
+		RunTransfers(ctx, deletes, dbox.Workers, dbox.Report),
+		RunTransfers(ctx, copies, dbox.Workers, dbox.Report),
+	)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (dbox *Dropbox) mirrorStep(ctx context.Context, plan *MirrorPlan, op MirrorOp) error {
+	local_path := filepath.Join(plan.Local, filepath.FromSlash(op.Path))
+	remote_path := plan.Remote + "/" + op.Path
+	switch {
+	case op.Op == "delete" && plan.Upload:
+		_, err := dbox.DeleteContext(ctx, remote_path)
+		return err
+	case op.Op == "delete":
+		return os.RemoveAll(local_path)
+	case op.IsDir && plan.Upload:
+		_, err := dbox.CreateFolderContext(ctx, remote_path)
+		return err
+	case op.IsDir:
+		return os.MkdirAll(local_path, 0755)
+	case plan.Upload:
+		_, err := dbox.uploadFile(ctx, remote_path, local_path, writeMode{Tag: "overwrite"}, false)
+		return withPath(err, remote_path)
+	default:
+		// The rev that was planned, not one uploaded since
+		return withPath(dbox.DownloadContext(ctx, "rev:"+op.rev, local_path), remote_path)
+	}
+}
+
+// joinTransferErrors combines the results of RunTransfers calls that
+// ran total transfers together.
+func joinTransferErrors(total int, errs ...error) error {
+	joined := &TransferError{Total: total}
+	for _, err := range errs {
+		var transfer_err *TransferError
+		if errors.As(err, &transfer_err) {
+			joined.Failed = append(joined.Failed, transfer_err.Failed...)
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(joined.Failed) == 0 {
+		return nil
+	}
+	return joined
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func opNames(plan *MirrorPlan) []string {
+	var names []string
+	for _, op := range plan.Ops {
+		names = append(names, op.Op+" "+op.Path)
+	}
+	return names
+}
+
+func TestMirrorUp(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	local := t.TempDir()
+	os.MkdirAll(filepath.Join(local, "dir"), 0755)
+	os.MkdirAll(filepath.Join(local, "empty"), 0755)
+	ioutil.WriteFile(filepath.Join(local, "same.txt"), []byte("same"), 0644)
+	ioutil.WriteFile(filepath.Join(local, "changed.txt"), []byte("new"), 0644)
+	ioutil.WriteFile(filepath.Join(local, "dir", "new.txt"), []byte("new"), 0644)
+	srv.PutFile("/m/same.txt", []byte("same"))
+	srv.PutFile("/m/changed.txt", []byte("old"))
+	srv.PutFile("/m/extra.txt", []byte("extra"))
+	srv.PutFile("/m/old/a.txt", []byte("a"))
+	srv.PutFile("/m/old/b.txt", []byte("b"))
+
+	plan, err := dbox.PlanMirror(local, "/m", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"delete extra.txt", "delete old", "update changed.txt", "create dir/new.txt", "create empty"}
+	if got := opNames(plan); !reflect.DeepEqual(got, want) {
+		t.Errorf("plan = %q, want %q", got, want)
+	}
+	// The files of a deleted folder count towards it
+	if op := plan.Ops[1]; op.Size != 2 {
+		t.Errorf("size of %s = %d, want 2", op.Path, op.Size)
+	}
+	if !srv.Exists("/m/extra.txt") {
+		t.Fatal("planning changed the destination")
+	}
+
+	uploads := srv.Requests("files/upload")
+	if err := dbox.Mirror(plan); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Requests("files/upload") - uploads; n != 2 {
+		t.Errorf("%d uploads, want 2", n)
+	}
+	if got, want := srv.Paths(), []string{"/m", "/m/changed.txt", "/m/dir", "/m/dir/new.txt", "/m/empty", "/m/same.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("remote = %q, want %q", got, want)
+	}
+	if plan, _ := dbox.PlanMirror(local, "/m", true); len(plan.Ops) != 0 {
+		t.Errorf("plan after the mirror = %q", opNames(plan))
+	}
+}
+
+func TestMirrorDown(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	local := t.TempDir()
+	srv.PutFile("/m/a.txt", []byte("a"))
+	srv.PutFile("/m/dir", []byte("file replacing a folder"))
+	os.MkdirAll(filepath.Join(local, "dir", "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(local, "dir", "sub", "x"), []byte("x"), 0644)
+	ioutil.WriteFile(filepath.Join(local, "extra.txt"), []byte("extra"), 0644)
+
+	plan, err := dbox.PlanMirror(local, "/m", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"delete dir", "delete extra.txt", "create a.txt", "create dir"}
+	if got := opNames(plan); !reflect.DeepEqual(got, want) {
+		t.Errorf("plan = %q, want %q", got, want)
+	}
+	if err := dbox.Mirror(plan); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(local)
+	if len(files) != 2 || files[0].Name() != "a.txt" || files[1].IsDir() {
+		t.Errorf("local folder after the mirror = %v", files)
+	}
+
+	if _, err := dbox.PlanMirror(local, "/missing", false); err == nil {
+		t.Error("mirror of a missing folder was planned")
+	}
+}
+
+func TestMirrorKeepsIgnored(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	dbox.Filter = NewFilter()
+	dbox.Filter.Global("node_modules/")
+	local := t.TempDir()
+	os.MkdirAll(filepath.Join(local, "proj", "node_modules"), 0755)
+	ioutil.WriteFile(filepath.Join(local, "proj", "node_modules", "x.js"), []byte("x"), 0644)
+	ioutil.WriteFile(filepath.Join(local, "proj", "a.txt"), []byte("a"), 0644)
+	srv.PutFile("/m/b.txt", []byte("b"))
+
+	// proj is not on the remote, but holds an ignored folder
+	plan, err := dbox.PlanMirror(local, "/m", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"delete proj/a.txt", "create b.txt"}
+	if got := opNames(plan); !reflect.DeepEqual(got, want) {
+		t.Errorf("plan = %q, want %q", got, want)
+	}
+	if err := dbox.Mirror(plan); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(local, "proj", "node_modules", "x.js")); err != nil {
+		t.Error("mirror down deleted an ignored file:", err)
+	}
+
+	// The same on the remote side
+	srv.PutFile("/up/proj/node_modules/y.js", []byte("y"))
+	srv.PutFile("/up/proj/c.txt", []byte("c"))
+	os.RemoveAll(filepath.Join(local, "proj"))
+	if plan, err = dbox.PlanMirror(local, "/up", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbox.Mirror(plan); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.File("/up/proj/node_modules/y.js"); !ok {
+		t.Error("mirror up deleted an ignored file")
+	}
+	if _, ok := srv.File("/up/proj/c.txt"); ok {
+		t.Error("mirror up kept a file that is not ignored")
+	}
+}
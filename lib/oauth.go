@@ -0,0 +1,202 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// kAuthorizeURL is the page where the user allows an app access to their
+// Dropbox.
+const kAuthorizeURL = "https://www.dropbox.com/oauth2/authorize"
+
+// PKCE is the proof key of an authorization code request, RFC 7636. The
+// challenge goes in the authorize url, the verifier with the code, so an
+// app without a secret can still prove the code was asked for by it.
+type PKCE struct {
+	Verifier  string
+	Challenge string
+}
+
+// NewPKCE returns a random verifier and its S256 challenge.
+func NewPKCE() (PKCE, error) {
+	verifier, err := randomString(32)
+	if err != nil {
+		return PKCE{}, err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return PKCE{Verifier: verifier, Challenge: base64.RawURLEncoding.EncodeToString(sum[:])}, nil
+}
+
+// randomString returns n random bytes, url safe base64 encoded.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthorizeURL returns the page that asks the user to allow the app
+// app_key. Dropbox sends the code to redirect_uri with state, or shows
+// it to be pasted back when redirect_uri is "".
+func AuthorizeURL(app_key string, redirect_uri string, state string, pkce PKCE) string {
+	parm := url.Values{
+		"client_id":             {app_key},
+		"response_type":         {"code"},
+		"code_challenge":        {pkce.Challenge},
+		"code_challenge_method": {"S256"},
+		// A refresh token, so the login lasts
+		"token_access_type": {"offline"},
+	}
+	if redirect_uri != "" {
+		parm.Set("redirect_uri", redirect_uri)
+	}
+	if state != "" {
+		parm.Set("state", state)
+	}
+	return kAuthorizeURL + "?" + parm.Encode()
+}
+
+// ExchangeCode trades an authorization code got with AuthorizeURL for a
+// token, which it sets as Token. redirect_uri must be the one of the
+// authorize url.
+func (dbox *Dropbox) ExchangeCode(app_key string, code string, redirect_uri string, verifier string) error {
+	return dbox.ExchangeCodeContext(context.Background(), app_key, code, redirect_uri, verifier)
+}
+
+// ExchangeCodeContext is ExchangeCode with a context.
+func (dbox *Dropbox) ExchangeCodeContext(ctx context.Context, app_key string, code string, redirect_uri string, verifier string) error {
+	parm := url.Values{"code": {code}, "grant_type": {"authorization_code"}, "client_id": {app_key}, "code_verifier": {verifier}}
+	if redirect_uri != "" {
+		parm.Set("redirect_uri", redirect_uri)
+	}
+	dbox.AppKey = app_key
+	return dbox.requestToken(ctx, parm)
+}
+
+// requestToken posts a grant to the token endpoint and sets Token from
+// the response.
+func (dbox *Dropbox) requestToken(ctx context.Context, parm url.Values) error {
+	token, err := dbox.postToken(ctx, parm)
+	if err != nil {
+		return err
+	}
+	dbox.setToken(token)
+	return nil
+}
+
+func (dbox *Dropbox) postToken(ctx context.Context, parm url.Values) (Token, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpointURL(dbox.ApiHost, "oauth2/token"), strings.NewReader(parm.Encode()))
+	if err != nil {
+		return Token{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := dbox.Client.Do(req)
+	if err != nil {
+		return Token{}, fmt.Errorf("Error in recieving token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return Token{}, newAPIError(resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Token{}, err
+	}
+	token := NewToken(body)
+	if token.AccessToken == "" {
+		return Token{}, errors.New("token response without an access token")
+	}
+	return *token, nil
+}
+
+// LoopbackRedirect receives the redirect of an authorization on
+// 127.0.0.1, so the code does not have to be pasted.
+type LoopbackRedirect struct {
+	// URL is the redirect_uri to authorize with
+	URL string
+
+	state    string
+	listener net.Listener
+	server   *http.Server
+	result   chan loopbackResult
+}
+
+type loopbackResult struct {
+	code string
+	err  error
+}
+
+// ListenLoopback starts a LoopbackRedirect on port, any free port when
+// 0, that accepts the redirect carrying state. Dropbox only redirects
+// to registered uris, so the port of the app settings must be used.
+func ListenLoopback(port int, state string) (*LoopbackRedirect, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, err
+	}
+	l := &LoopbackRedirect{
+		URL:      fmt.Sprintf("http://127.0.0.1:%d/callback", listener.Addr().(*net.TCPAddr).Port),
+		state:    state,
+		listener: listener,
+		result:   make(chan loopbackResult, 1),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", l.callback)
+	l.server = &http.Server{Handler: mux}
+	go l.server.Serve(listener)
+	return l, nil
+}
+
+func (l *LoopbackRedirect) callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	// Anything else on the machine can call us, only the state proves
+	// the redirect comes from our authorize url
+	if query.Get("state") != l.state {
+		http.Error(w, "Unexpected state, try to log in again.", http.StatusBadRequest)
+		return
+	}
+	var result loopbackResult
+	if oauth_err := query.Get("error"); oauth_err != "" {
+		result.err = fmt.Errorf("authorization failed: %s %s", oauth_err, query.Get("error_description"))
+		fmt.Fprintln(w, "Authorization failed, you can close this page.")
+	} else if result.code = query.Get("code"); result.code == "" {
+		result.err = errors.New("authorization failed: no code in the redirect")
+		fmt.Fprintln(w, "Authorization failed, you can close this page.")
+	} else {
+		fmt.Fprintln(w, "Logged in, you can close this page and go back to gdbox.")
+	}
+	select {
+	case l.result <- result:
+	default:
+	}
+}
+
+// Wait returns the code of the first redirect with the right state.
+func (l *LoopbackRedirect) Wait(ctx context.Context) (string, error) {
+	select {
+	case result := <-l.result:
+		return result.code, result.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Close stops listening.
+func (l *LoopbackRedirect) Close() error {
+	return l.server.Close()
+}
+
+// NewState returns a random state for AuthorizeURL.
+func NewState() (string, error) {
+	return randomString(16)
+}
@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPKCE(t *testing.T) {
+	pkce, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 7636 wants 43 to 128 characters
+	if len(pkce.Verifier) < 43 || len(pkce.Verifier) > 128 {
+		t.Errorf("verifier of %d characters", len(pkce.Verifier))
+	}
+	sum := sha256.Sum256([]byte(pkce.Verifier))
+	if pkce.Challenge != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		t.Errorf("challenge %q is not the S256 of the verifier", pkce.Challenge)
+	}
+	other, _ := NewPKCE()
+	if other.Verifier == pkce.Verifier {
+		t.Error("verifiers repeat")
+	}
+
+	u, err := url.Parse(AuthorizeURL("app", "http://127.0.0.1:1/callback", "state", pkce))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	for key, want := range map[string]string{
+		"client_id":             "app",
+		"response_type":         "code",
+		"code_challenge":        pkce.Challenge,
+		"code_challenge_method": "S256",
+		"redirect_uri":          "http://127.0.0.1:1/callback",
+		"state":                 "state",
+	} {
+		if got := query.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestExchangeCode(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	pkce, _ := NewPKCE()
+	code := srv.Authorize("app", pkce.Challenge, "")
+	if err := dbox.ExchangeCode("app", code, "", "wrong verifier"); err == nil {
+		t.Error("code exchanged with a wrong verifier")
+	}
+	code = srv.Authorize("app", pkce.Challenge, "")
+	if err := dbox.ExchangeCode("app", code, "", pkce.Verifier); err != nil || dbox.Token.AccessToken == "" {
+		t.Errorf("ExchangeCode = %v, token %q", err, dbox.Token.AccessToken)
+	}
+	// Codes are used once
+	if err := dbox.ExchangeCode("app", code, "", pkce.Verifier); err == nil {
+		t.Error("code exchanged twice")
+	} else if api_err, ok := err.(*APIError); !ok || !api_err.HasTag("invalid_grant") {
+		t.Errorf("second exchange = %v", err)
+	}
+}
+
+func TestLoopbackRedirect(t *testing.T) {
+	redirect, err := ListenLoopback(0, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redirect.Close()
+	get := func(query string) {
+		resp, err := http.Get(redirect.URL + "?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// A redirect without our state is not taken
+	get("code=forged&state=other")
+	get("code=abc&state=state")
+	if code, err := redirect.Wait(context.Background()); err != nil || code != "abc" {
+		t.Errorf("Wait = %q, %v", code, err)
+	}
+	get("error=access_denied&error_description=denied&state=state")
+	if _, err := redirect.Wait(context.Background()); err == nil || !strings.Contains(err.Error(), "access_denied") {
+		t.Errorf("Wait after a denial = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := redirect.Wait(ctx); err != context.Canceled {
+		t.Errorf("Wait canceled = %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ConflictPolicy decides what an upload does when the remote file
+// already exists, and what Sync does with a file changed on both sides.
+type ConflictPolicy string
+
+const (
+	// PolicyOverwrite replaces the remote file.
+	PolicyOverwrite ConflictPolicy = "overwrite"
+	// PolicySkip keeps the remote file and skips the upload.
+	PolicySkip ConflictPolicy = "skip"
+	// PolicyRename keeps both, the upload is saved under a free name.
+	PolicyRename ConflictPolicy = "rename"
+	// PolicyFail fails the upload with ErrConflict.
+	PolicyFail ConflictPolicy = "fail"
+	// PolicyNewer keeps whichever file was modified last.
+	PolicyNewer ConflictPolicy = "newer"
+	// PolicyUpdate replaces the remote file only if it is still the
+	// rev the caller knew of, ExpectedRev for Upload and the rev of the
+	// last sync for Sync, and fails with ErrConflict otherwise.
+	PolicyUpdate ConflictPolicy = "update"
+)
+
+// ConflictPolicies are the valid policies.
+var ConflictPolicies = []ConflictPolicy{PolicyOverwrite, PolicySkip, PolicyRename, PolicyFail, PolicyNewer, PolicyUpdate}
+
+// ParseConflictPolicy checks the name of a policy.
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	var names []string
+	for _, policy := range ConflictPolicies {
+		if string(policy) == name {
+			return policy, nil
+		}
+		names = append(names, string(policy))
+	}
+	return "", fmt.Errorf("unknown conflict policy %q, use one of %s", name, strings.Join(names, ", "))
+}
+
+// policy returns Policy, or fallback when it is not set.
+func (dbox *Dropbox) policy(fallback ConflictPolicy) ConflictPolicy {
+	if dbox.Policy == "" {
+		return fallback
+	}
+	return dbox.Policy
+}
+
+// uploadWithPolicy uploads a file, resolving an existing remote file
+// with policy, and returns the outcome to report.
+func (dbox *Dropbox) uploadWithPolicy(ctx context.Context, remote_path string, local_path string, policy ConflictPolicy, resume bool) (string, error) {
+	mode := writeMode{Tag: "overwrite"}
+	switch policy {
+	case PolicyRename:
+		mode = writeMode{Tag: "add", Autorename: true}
+	case PolicyFail:
+		mode.Tag = "add"
+	case PolicyUpdate:
+		// Only the caller knows the rev it saw, looking it up now would
+		// replace whatever is there
+		mode.Tag = "add"
+		if dbox.ExpectedRev != "" {
+			mode = writeMode{Tag: "update", Rev: dbox.ExpectedRev}
+		}
+	case PolicySkip, PolicyNewer:
+		remote, err := dbox.StatContext(ctx, remote_path)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			mode.Tag = "add"
+		case err != nil:
+			return "", err
+		case policy == PolicySkip:
+			return "skipped, exists", nil
+		case remote.IsDir:
+			// Fails with a conflict
+			mode.Tag = "add"
+		case policy == PolicyNewer:
+			stat, err := os.Stat(local_path)
+			if err != nil {
+				return "", err
+			}
+			if !remoteOlder(remote, stat.ModTime()) {
+				return "skipped, remote is newer", nil
+			}
+			mode = writeMode{Tag: "update", Rev: remote.Rev}
+		}
+	}
+	metadata, err := dbox.uploadFile(ctx, remote_path, local_path, mode, resume)
+	if policy == PolicySkip && errors.Is(err, ErrConflict) {
+		// Created since it was looked up
+		return "skipped, exists", nil
+	}
+	if err != nil {
+		return "", withPath(err, remote_path)
+	}
+	if !strings.EqualFold(metadata.Path, remote_path) {
+		return "renamed to " + metadata.Path, nil
+	}
+	return "", nil
+}
+
+// remoteOlder reports whether a remote file was modified before
+// mod_time. Dropbox keeps modification times to the second.
+func remoteOlder(remote Metadata, mod_time time.Time) bool {
+	client_modified, err := time.Parse(time.RFC3339, remote.ClientModified)
+	return err != nil || client_modified.Before(mod_time.Truncate(time.Second))
+}
@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadPolicies(t *testing.T) {
+	old := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		policy  ConflictPolicy
+		mtime   time.Time // of the local file, the remote one is from 2020
+		want    string    // at /p/a.txt
+		outcome string
+		err     error
+	}{
+		{PolicyOverwrite, time.Now(), "local", "", nil},
+		{PolicySkip, time.Now(), "remote", "skipped, exists", nil},
+		{PolicyRename, time.Now(), "remote", "renamed to /p/a (1).txt", nil},
+		{PolicyFail, time.Now(), "remote", "", ErrConflict},
+		{PolicyNewer, time.Now(), "local", "", nil},
+		{PolicyNewer, old, "remote", "skipped, remote is newer", nil},
+		// Without ExpectedRev an existing file is not replaced
+		{PolicyUpdate, time.Now(), "remote", "", ErrConflict},
+	}
+	for _, test := range tests {
+		srv, dbox := newTestDropbox(t)
+		local := filepath.Join(t.TempDir(), "a.txt")
+		ioutil.WriteFile(local, []byte("local"), 0644)
+		os.Chtimes(local, test.mtime, test.mtime)
+		srv.PutFile("/p/a.txt", []byte("remote"))
+
+		var results []TransferResult
+		dbox.Policy = test.policy
+		dbox.Report = func(result TransferResult) { results = append(results, result) }
+		err := dbox.Upload("/p/a.txt", local)
+		if !errors.Is(err, test.err) || test.err == nil && err != nil {
+			t.Errorf("%s: err = %v, want %v", test.policy, err, test.err)
+		}
+		if data, _ := srv.File("/p/a.txt"); string(data) != test.want {
+			t.Errorf("%s: remote = %q, want %q", test.policy, data, test.want)
+		}
+		if len(results) != 1 || results[0].Outcome != test.outcome {
+			t.Errorf("%s: results = %v, want outcome %q", test.policy, results, test.outcome)
+		}
+	}
+
+	// A new file is uploaded whatever the policy
+	for _, policy := range ConflictPolicies {
+		srv, dbox := newTestDropbox(t)
+		local := filepath.Join(t.TempDir(), "a.txt")
+		ioutil.WriteFile(local, []byte("local"), 0644)
+		os.Chtimes(local, old, old)
+		dbox.Policy = policy
+		if err := dbox.Upload("/p/a.txt", local); err != nil {
+			t.Errorf("%s: %v", policy, err)
+		}
+		if data, _ := srv.File("/p/a.txt"); string(data) != "local" {
+			t.Errorf("%s: remote = %q", policy, data)
+		}
+		// The local mtime is kept
+		if metadata, _ := dbox.GetMetaData("/p/a.txt"); metadata.ClientModified != "2019-01-01T00:00:00Z" {
+			t.Errorf("%s: client_modified = %q", policy, metadata.ClientModified)
+		}
+	}
+}
+
+func TestUploadUpdate(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	local := filepath.Join(t.TempDir(), "a.txt")
+	ioutil.WriteFile(local, []byte("local"), 0644)
+	srv.PutFile("/a.txt", []byte("first"))
+	dbox.Policy = PolicyUpdate
+
+	// The rev is read, then another writer replaces it before the upload
+	metadata, err := dbox.Stat("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.PutFile("/a.txt", []byte("other"))
+	dbox.ExpectedRev = metadata.Rev
+	if err := dbox.Upload("/a.txt", local); !errors.Is(err, ErrConflict) {
+		t.Errorf("upload over a changed rev: %v, want ErrConflict", err)
+	}
+	if data, _ := srv.File("/a.txt"); string(data) != "other" {
+		t.Errorf("remote = %q, the other writer's file was replaced", data)
+	}
+
+	dbox.ExpectedRev = srv.Rev("/a.txt")
+	if err := dbox.Upload("/a.txt", local); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := srv.File("/a.txt"); string(data) != "local" {
+		t.Errorf("remote = %q after an update of the current rev", data)
+	}
+
+	// One rev can not be that of every file of a folder
+	uploads := srv.Requests("files/upload")
+	if err := dbox.Upload("/dir", filepath.Dir(local)); err == nil {
+		t.Error("folder uploaded with an expected rev")
+	}
+	if n := srv.Requests("files/upload") - uploads; n != 0 {
+		t.Errorf("%d files of the folder uploaded", n)
+	}
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	if policy, err := ParseConflictPolicy("newer"); policy != PolicyNewer || err != nil {
+		t.Errorf("ParseConflictPolicy(newer) = %q, %v", policy, err)
+	}
+	if _, err := ParseConflictPolicy("newest"); err == nil {
+		t.Error("ParseConflictPolicy(newest) did not fail")
+	}
+}
+
+func TestSyncPolicies(t *testing.T) {
+	old := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		policy  ConflictPolicy
+		mtime   time.Time
+		local   string // after the sync
+		remote  string
+		outcome string
+	}{
+		{PolicyOverwrite, time.Now(), "mine", "mine", "kept local"},
+		{PolicyUpdate, time.Now(), "mine", "theirs", ""},
+		{PolicySkip, time.Now(), "mine", "theirs", "skipped"},
+		{PolicyFail, time.Now(), "mine", "theirs", ""},
+		{PolicyNewer, time.Now(), "mine", "mine", "kept local"},
+		{PolicyNewer, old, "theirs", "theirs", "kept remote"},
+	}
+	for _, test := range tests {
+		srv, dbox := newTestDropbox(t)
+		local := t.TempDir()
+		state, _ := LoadSyncState(filepath.Join(t.TempDir(), "state.json"))
+		file := filepath.Join(local, "a.txt")
+		ioutil.WriteFile(file, []byte("base"), 0644)
+		if err := dbox.Sync(local, "/s", state); err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(file, []byte("mine"), 0644)
+		os.Chtimes(file, test.mtime, test.mtime)
+		srv.PutFile("/s/a.txt", []byte("theirs"))
+
+		var results []TransferResult
+		dbox.Policy = test.policy
+		dbox.Report = func(result TransferResult) { results = append(results, result) }
+		err := dbox.Sync(local, "/s", state)
+		if test.policy == PolicyFail || test.policy == PolicyUpdate {
+			if !errors.Is(err, ErrConflict) {
+				t.Errorf("%s: err = %v, want ErrConflict", test.policy, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", test.policy, err)
+		}
+		if data, _ := ioutil.ReadFile(file); string(data) != test.local {
+			t.Errorf("%s: local = %q, want %q", test.policy, data, test.local)
+		}
+		if data, _ := srv.File("/s/a.txt"); string(data) != test.remote {
+			t.Errorf("%s: remote = %q, want %q", test.policy, data, test.remote)
+		}
+		if len(results) != 1 || results[0].Outcome != test.outcome {
+			t.Errorf("%s: results = %v, want outcome %q", test.policy, results, test.outcome)
+		}
+		if matches, _ := filepath.Glob(filepath.Join(local, "*conflicted*")); len(matches) > 0 {
+			t.Errorf("%s: made a conflicted copy", test.policy)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Backoff between tries when the server does not send Retry-After
+const (
+	kRetryBase = 500 * time.Millisecond
+	kRetryMax  = 30 * time.Second
+)
+
+// Endpoints that are safe to send twice. Other endpoints are retried
+// only when rate limited, since the request was not processed then.
+// Appends are safe because the offset is checked, see chunkedUpload.
+var kIdempotent = map[string]bool{
+	"users/get_current_account":      true,
+	"files/get_metadata":             true,
+	"files/list_folder":              true,
+	"files/list_folder/continue":     true,
+	"files/list_folder/longpoll":     true,
+	"files/search_v2":                true,
+	"files/download":                 true,
+	"files/upload_session/start":     true,
+	"files/upload_session/append_v2": true,
+}
+
+// Endpoints that take no access token and fail when sent one
+var kNoAuth = map[string]bool{
+	"files/list_folder/longpoll": true,
+}
+
+// RetryStats counts the requests sent by a Dropbox client.
+type RetryStats struct {
+	Requests    int64
+	Retries     int64
+	RateLimited int64
+}
+
+// Stats returns the request counters of the client.
+func (dbox *Dropbox) Stats() RetryStats {
+	return RetryStats{
+		Requests:    atomic.LoadInt64(&dbox.stats.Requests),
+		Retries:     atomic.LoadInt64(&dbox.stats.Retries),
+		RateLimited: atomic.LoadInt64(&dbox.stats.RateLimited),
+	}
+}
+
+// backoff returns the wait before try+1: exponential with jitter.
+func backoff(try int) time.Duration {
+	wait := kRetryMax
+	if try < 16 {
+		if d := kRetryBase << uint(try-1); d < wait {
+			wait = d
+		}
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// do sends the request made by new_request, trying up to MaxTries times.
+// Rate limited requests are always retried, server and network errors
+// only for idempotent endpoints. An access token about to expire is
+// refreshed first, and one refused with 401 is refreshed once and the
+// request sent again. Any status other than 200 and 206 is returned as
+// an *APIError.
+func (dbox *Dropbox) do(ctx context.Context, endpoint string, new_request func() (*http.Request, error)) (*http.Response, error) {
+	refreshed := false
+	for try := 1; ; try++ {
+		req, err := new_request()
+		if err != nil {
+			return nil, err
+		}
+		var used string
+		if !kNoAuth[endpoint] {
+			token := dbox.token()
+			if !refreshed && dbox.canRefresh(token) && token.Expiring(kRefreshMargin) {
+				refreshed = true
+				// The old token still works for a while if this fails
+				if err := dbox.refresh(ctx, token.AccessToken); err != nil && token.Expiring(0) {
+					return nil, fmt.Errorf("refreshing the access token: %w", err)
+				}
+				token = dbox.token()
+			}
+			used = token.AccessToken
+			req.Header.Set("Authorization", "Bearer "+used)
+		}
+		atomic.AddInt64(&dbox.stats.Requests, 1)
+		resp, err := dbox.Client.Do(req)
+		if err == nil && (resp.StatusCode == 200 || resp.StatusCode == 206) {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			if err == nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+		retry := kIdempotent[endpoint]
+		if err == nil {
+			err = newAPIError(resp)
+			resp.Body.Close()
+		}
+		var (
+			api_err *APIError
+			wait    time.Duration
+		)
+		if errors.As(err, &api_err) {
+			wait = api_err.RetryAfter
+			switch {
+			case api_err.StatusCode == 401 && used != "" && !refreshed && dbox.canRefresh(dbox.token()):
+				// Not processed, so safe to send again with a new token
+				refreshed = true
+				if err := dbox.refresh(ctx, used); err != nil {
+					return nil, fmt.Errorf("refreshing the access token: %w", err)
+				}
+				try--
+				continue
+			case api_err.StatusCode == 429:
+				atomic.AddInt64(&dbox.stats.RateLimited, 1)
+				retry = true
+			case api_err.StatusCode < 500:
+				retry = false
+			}
+		}
+		if !retry || try >= dbox.MaxTries {
+			return nil, err
+		}
+		if wait == 0 {
+			wait = backoff(try)
+		}
+		atomic.AddInt64(&dbox.stats.Retries, 1)
+		if err := dbox.sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryMismatch runs transfer again while the data it moved does not
+// match the content hash, up to MaxTries times.
+func (dbox *Dropbox) retryMismatch(ctx context.Context, transfer func() error) error {
+	for try := 1; ; try++ {
+		err := transfer()
+		if !errors.Is(err, ErrHashMismatch) || try >= dbox.MaxTries || ctx.Err() != nil {
+			return err
+		}
+		atomic.AddInt64(&dbox.stats.Retries, 1)
+	}
+}
@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetryIdempotent(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/a.txt", []byte("a"))
+	var waits []time.Duration
+	dbox.sleep = func(ctx context.Context, d time.Duration) error { waits = append(waits, d); return nil }
+
+	srv.FailNext("files/get_metadata", 503, 2)
+	if _, err := dbox.GetMetaData("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := dbox.Stats(); stats.Retries != 2 || stats.Requests != 3 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if len(waits) != 2 || waits[1] < kRetryBase {
+		t.Errorf("waits = %v", waits)
+	}
+
+	srv.FailNext("files/get_metadata", 500, dbox.MaxTries)
+	if _, err := dbox.GetMetaData("/a.txt"); !errors.Is(err, ErrServer) {
+		t.Errorf("GetMetaData after %d failures = %v", dbox.MaxTries, err)
+	}
+}
+
+func TestRetryNotIdempotent(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/a.txt", []byte("a"))
+	srv.RetryAfter = 3
+	var waits []time.Duration
+	dbox.sleep = func(ctx context.Context, d time.Duration) error { waits = append(waits, d); return nil }
+
+	// A copy that failed with 500 may have happened, so it is not retried
+	srv.FailNext("files/copy_v2", 500, 1)
+	if _, err := dbox.Copy("/a.txt", "/b.txt"); !errors.Is(err, ErrServer) {
+		t.Errorf("Copy = %v, want a server error", err)
+	}
+	// Rate limited requests were not processed
+	srv.FailNext("files/copy_v2", 429, 1)
+	if _, err := dbox.Copy("/a.txt", "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if len(waits) != 1 || waits[0] != 3*time.Second {
+		t.Errorf("waits = %v, want Retry-After", waits)
+	}
+	if stats := dbox.Stats(); stats.RateLimited != 1 || stats.Retries != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestRetryAppend(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	defer func(limit int64) { kDboxConst.DirectUploadSizeLimit = limit }(kDboxConst.DirectUploadSizeLimit)
+	kDboxConst.DirectUploadSizeLimit = 10
+
+	data := bytes.Repeat([]byte("0123456789"), 3)
+	local := filepath.Join(t.TempDir(), "f")
+	ioutil.WriteFile(local, data, 0644)
+	srv.LoseNext("files/upload_session/append_v2", 1)
+	if err := dbox.Upload("/f", local); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := srv.File("/f"); !bytes.Equal(got, data) {
+		t.Errorf("uploaded %q, want %q", got, data)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for try := 1; try < 40; try++ {
+		wait := backoff(try)
+		if wait <= 0 || wait > kRetryMax {
+			t.Errorf("backoff(%d) = %v", try, wait)
+		}
+	}
+}
+
+// roundTripFunc is an http.RoundTripper made of a function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// closeRecorder is a response body that records whether it was closed.
+type closeRecorder struct {
+	*bytes.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestCanceledResponseClosed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	body := &closeRecorder{Reader: bytes.NewReader([]byte("error"))}
+	dbox := NewDropbox(Token{AccessToken: "token"})
+	// Canceled while the error response comes back
+	dbox.Client = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		cancel()
+		return &http.Response{StatusCode: 500, Header: make(http.Header), Body: body, Request: req}, nil
+	})}
+	if _, err := dbox.GetAccountContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetAccount = %v, want canceled", err)
+	}
+	if !body.closed {
+		t.Error("response body of a canceled request was not closed")
+	}
+}
@@ -0,0 +1,425 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncState is what Sync remembers of the files it synced, so the next
+// run can tell an edit on one side from a deletion on the other. It is
+// kept in a json file between runs.
+type SyncState struct {
+	Local  string              `json:"local"`
+	Remote string              `json:"remote"`
+	Files  map[string]SyncFile `json:"files"` // keyed by lower case relative path
+
+	path string
+	mu   sync.Mutex
+}
+
+// SyncFile is a file as it was after it was last synced: the rev and
+// content hash on Dropbox and the size and mtime of the local copy.
+type SyncFile struct {
+	Path        string    `json:"path"`
+	Rev         string    `json:"rev"`
+	ContentHash string    `json:"content_hash"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mtime"`
+}
+
+// LoadSyncState reads the state kept in state_path, a missing file is
+// an empty state.
+func LoadSyncState(state_path string) (*SyncState, error) {
+	state := &SyncState{path: state_path}
+	data, err := ioutil.ReadFile(state_path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, fmt.Errorf("%s: %v", state_path, err)
+		}
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]SyncFile)
+	}
+	return state, nil
+}
+
+// Save writes the state back to the file it was loaded from.
+func (s *SyncState) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(s)
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *SyncState) set(file SyncFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Files[strings.ToLower(file.Path)] = file
+}
+
+func (s *SyncState) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Files, key)
+}
+
+// localFile is a file found under the local folder of a sync.
+type localFile struct {
+	Path    string // relative, with forward slashes
+	Size    int64
+	ModTime time.Time
+}
+
+// isTempName reports whether name is one of the temporary files of
+// Download and DownloadResume.
+func isTempName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, ".gdbox-") ||
+		strings.HasSuffix(name, kPartialSuffix) || strings.HasSuffix(name, kPartialSuffix+".json")
+}
+
+// scanLocal returns the regular files and the folders under root keyed
+// by their lower case relative path, without what Filter ignores. kept,
+// if not nil, gets the folders with something ignored in them.
+func (dbox *Dropbox) scanLocal(root string, kept map[string]bool) (map[string]localFile, map[string]string, error) {
+	files := make(map[string]localFile)
+	dirs := make(map[string]string)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		rel = filepath.ToSlash(rel)
+		if ignored, _ := dbox.Filter.match(root, rel, info.IsDir()); ignored {
+			markParents(kept, strings.ToLower(rel))
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() && rel != "." {
+			dirs[strings.ToLower(rel)] = rel
+		}
+		if !info.Mode().IsRegular() || isTempName(info.Name()) {
+			return nil
+		}
+		files[strings.ToLower(rel)] = localFile{Path: rel, Size: info.Size(), ModTime: info.ModTime()}
+		return nil
+	})
+	return files, dirs, err
+}
+
+// scanRemote returns the files and the folders under root keyed by
+// their lower case relative path, without what Filter ignores with the
+// ignore files of local_root. A missing root has none when must_exist
+// is false. kept is as for scanLocal.
+func (dbox *Dropbox) scanRemote(ctx context.Context, root string, local_root string, must_exist bool, kept map[string]bool) (map[string]Metadata, map[string]string, error) {
+	files := make(map[string]Metadata)
+	dirs := make(map[string]string)
+	err := dbox.WalkContext(ctx, root, func(entry Metadata) error {
+		if len(entry.Path) <= len(root) {
+			// Walk of a file
+			return fmt.Errorf("dropbox: %s: not a folder", root)
+		}
+		// Keep the case of the display path, without the root
+		entry.Path = entry.Path[len(root)+1:]
+		if ignored, _ := dbox.Filter.match(local_root, entry.Path, entry.IsDir); ignored {
+			markParents(kept, strings.ToLower(entry.Path))
+			return filepath.SkipDir
+		}
+		if entry.IsDir {
+			dirs[strings.ToLower(entry.Path)] = entry.Path
+		} else if entry.Tag == "file" {
+			files[strings.ToLower(entry.Path)] = entry
+		}
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) && !must_exist {
+		return files, dirs, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return files, dirs, nil
+}
+
+// Sync makes local_path and remote_path hold the same files. Files
+// added, edited or deleted on either side since the last Sync with the
+// same state are added, replaced or deleted on the other side. A file
+// changed on both sides is resolved by Policy; by default it is
+// downloaded and the local version kept next to it as a conflicted
+// copy, which is uploaded too. Empty folders are
+// not synced. The transfers run on Workers goroutines and are reported
+// to Report, the state is saved at the end.
+func (dbox *Dropbox) Sync(local_path string, remote_path string, state *SyncState) error {
+	return dbox.SyncContext(context.Background(), local_path, remote_path, state)
+}
+
+// SyncContext is Sync with a context.
+func (dbox *Dropbox) SyncContext(ctx context.Context, local_path string, remote_path string, state *SyncState) error {
+	local_root, err := filepath.Abs(local_path)
+	if err != nil {
+		return err
+	}
+	remote_root := apiPath(remote_path)
+	if state.Local == "" && state.Remote == "" {
+		state.Local, state.Remote = local_root, remote_root
+	} else if state.Local != local_root || !strings.EqualFold(state.Remote, remote_root) {
+		return fmt.Errorf("sync state of %s and %s used for %s and %s", state.Local, state.Remote, local_root, remote_root)
+	}
+	if err := os.MkdirAll(local_root, 0755); err != nil {
+		return err
+	}
+	locals, _, err := dbox.scanLocal(local_root, nil)
+	if err != nil {
+		return err
+	}
+	remotes, _, err := dbox.scanRemote(ctx, remote_root, local_root, false, nil)
+	if err != nil {
+		return err
+	}
+	plan := &syncPlan{dbox: dbox, state: state, local_root: local_root, remote_root: remote_root, policy: dbox.policy(PolicyRename)}
+	if err := plan.make(locals, remotes); err != nil {
+		return err
+	}
+	err = RunTransfers(ctx, plan.transfers, dbox.Workers, dbox.Report)
+	if save_err := state.Save(); err == nil {
+		err = save_err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// syncPlan collects the transfers that bring both sides of a sync in line.
+type syncPlan struct {
+	dbox        *Dropbox
+	state       *SyncState
+	local_root  string
+	remote_root string
+	policy      ConflictPolicy // of files changed on both sides
+	transfers   []Transfer
+}
+
+func (p *syncPlan) localPath(rel string) string {
+	return filepath.Join(p.local_root, filepath.FromSlash(rel))
+}
+
+func (p *syncPlan) remotePath(rel string) string {
+	return p.remote_root + "/" + rel
+}
+
+func (p *syncPlan) add(op string, rel string, run func(ctx context.Context) (string, error)) {
+	p.transfers = append(p.transfers, Transfer{Name: op + " " + rel, Run: run})
+}
+
+// make compares every file with its synced state and plans what to do.
+func (p *syncPlan) make(locals map[string]localFile, remotes map[string]Metadata) error {
+	var keys []string
+	for key := range locals {
+		keys = append(keys, key)
+	}
+	for key := range remotes {
+		if _, ok := locals[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	for key := range p.state.Files {
+		_, in_local := locals[key]
+		if _, in_remote := remotes[key]; !in_local && !in_remote {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		base, synced := p.state.Files[key]
+		local, in_local := locals[key]
+		remote, in_remote := remotes[key]
+
+		local_hash := base.ContentHash
+		if in_local && !(synced && local.Size == base.Size && local.ModTime.Equal(base.ModTime)) {
+			var err error
+			if local_hash, err = FileContentHash(p.localPath(local.Path)); err != nil {
+				return err
+			}
+		}
+		local_changed := in_local && (!synced || local_hash != base.ContentHash)
+		remote_changed := in_remote && (!synced || remote.ContentHash != base.ContentHash)
+
+		switch {
+		case !in_local && !in_remote:
+			// Deleted on both sides
+			p.state.forget(key)
+		case local_changed && remote_changed:
+			if local_hash == remote.ContentHash {
+				p.state.set(p.synced(local, remote))
+			} else {
+				p.conflict(local, remote, base)
+			}
+		case local_changed:
+			mode := writeMode{Tag: "add"}
+			if in_remote {
+				mode = writeMode{Tag: "update", Rev: remote.Rev}
+			}
+			p.upload(local, mode)
+		case remote_changed:
+			p.download(remote)
+		case !in_local:
+			p.deleteRemote(key, remote)
+		case !in_remote:
+			p.deleteLocal(key, local)
+		default:
+			// Unchanged, but the rev or mtime may be new
+			p.state.set(p.synced(local, remote))
+		}
+	}
+	return nil
+}
+
+// synced is the state of a file that is the same on both sides.
+func (p *syncPlan) synced(local localFile, remote Metadata) SyncFile {
+	return SyncFile{Path: local.Path, Rev: remote.Rev, ContentHash: remote.ContentHash, Size: local.Size, ModTime: local.ModTime}
+}
+
+func (p *syncPlan) upload(local localFile, mode writeMode) {
+	p.add("upload", local.Path, func(ctx context.Context) (string, error) {
+		return "", p.sendLocal(ctx, local, mode)
+	})
+}
+
+func (p *syncPlan) sendLocal(ctx context.Context, local localFile, mode writeMode) error {
+	remote_path := p.remotePath(local.Path)
+	metadata, err := p.dbox.uploadFile(ctx, remote_path, p.localPath(local.Path), mode, false)
+	if err != nil {
+		return withPath(err, remote_path)
+	}
+	p.state.set(p.synced(local, metadata))
+	return nil
+}
+
+func (p *syncPlan) download(remote Metadata) {
+	p.add("download", remote.Path, func(ctx context.Context) (string, error) {
+		return "", p.fetchRemote(ctx, remote, remote.Path)
+	})
+}
+
+// fetchRemote downloads the rev of remote that was listed to rel.
+func (p *syncPlan) fetchRemote(ctx context.Context, remote Metadata, rel string) error {
+	local_path := p.localPath(rel)
+	if err := p.dbox.DownloadContext(ctx, "rev:"+remote.Rev, local_path); err != nil {
+		return withPath(err, p.remotePath(remote.Path))
+	}
+	stat, err := os.Stat(local_path)
+	if err != nil {
+		return err
+	}
+	p.state.set(p.synced(localFile{Path: rel, Size: stat.Size(), ModTime: stat.ModTime()}, remote))
+	return nil
+}
+
+func (p *syncPlan) deleteRemote(key string, remote Metadata) {
+	p.add("delete remote", remote.Path, func(ctx context.Context) (string, error) {
+		// Only the rev that was listed, a newer edit is kept
+		if _, err := p.dbox.deleteRev(ctx, p.remotePath(remote.Path), remote.Rev); err != nil {
+			return "", err
+		}
+		p.state.forget(key)
+		return "", nil
+	})
+}
+
+func (p *syncPlan) deleteLocal(key string, local localFile) {
+	p.add("delete local", local.Path, func(ctx context.Context) (string, error) {
+		local_path := p.localPath(local.Path)
+		stat, err := os.Stat(local_path)
+		if err != nil {
+			return "", err
+		}
+		if stat.Size() != local.Size || !stat.ModTime().Equal(local.ModTime) {
+			return "", fmt.Errorf("%s: changed during sync, not deleted", local_path)
+		}
+		if err := os.Remove(local_path); err != nil {
+			return "", err
+		}
+		p.state.forget(key)
+		return "", nil
+	})
+}
+
+// conflict resolves a file changed on both sides with the policy of the
+// plan. Rename keeps the local version as a conflicted copy, uploads it,
+// and downloads the remote version in its place. base is the file as it
+// was last synced.
+func (p *syncPlan) conflict(local localFile, remote Metadata, base SyncFile) {
+	p.add("conflict", local.Path, func(ctx context.Context) (string, error) {
+		switch p.policy {
+		case PolicyOverwrite:
+			return "kept local", p.sendLocal(ctx, local, writeMode{Tag: "overwrite"})
+		case PolicyUpdate:
+			// Only over the rev of the last sync, so a file changed on
+			// both sides fails with ErrConflict
+			mode := writeMode{Tag: "add"}
+			if base.Rev != "" {
+				mode = writeMode{Tag: "update", Rev: base.Rev}
+			}
+			if err := p.sendLocal(ctx, local, mode); err != nil {
+				return "", err
+			}
+			return "kept local", nil
+		case PolicySkip:
+			// Left for a later sync
+			return "skipped", nil
+		case PolicyFail:
+			return "", fmt.Errorf("%s: changed on both sides: %w", p.remotePath(remote.Path), ErrConflict)
+		case PolicyNewer:
+			if remoteOlder(remote, local.ModTime) {
+				return "kept local", p.sendLocal(ctx, local, writeMode{Tag: "update", Rev: remote.Rev})
+			}
+			return "kept remote", p.fetchRemote(ctx, remote, local.Path)
+		}
+		copy_path := conflictName(p.localPath(local.Path))
+		if err := os.Rename(p.localPath(local.Path), copy_path); err != nil {
+			return "", err
+		}
+		if err := p.fetchRemote(ctx, remote, local.Path); err != nil {
+			return "", err
+		}
+		local.Path = path.Join(path.Dir(local.Path), filepath.Base(copy_path))
+		return "local renamed to " + filepath.Base(copy_path), p.sendLocal(ctx, local, writeMode{Tag: "add"})
+	})
+}
+
+// conflictName returns a free name for the local version of a file
+// changed on both sides, named like the conflicted copies of Dropbox.
+func conflictName(local_path string) string {
+	ext := filepath.Ext(local_path)
+	base := strings.TrimSuffix(local_path, ext) + " (conflicted copy " + time.Now().Format("2006-01-02")
+	name := base + ")" + ext
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s %d)%s", base, i, ext)
+	}
+}
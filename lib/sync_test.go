@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSync(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	local := t.TempDir()
+	state, err := LoadSyncState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, data string) {
+		p := filepath.Join(local, name)
+		ioutil.WriteFile(p, []byte(data), 0644)
+		// Edits within the mtime granularity must still be seen
+		later := time.Now().Add(time.Duration(len(data)) * time.Minute)
+		os.Chtimes(p, later, later)
+	}
+	sync := func() {
+		t.Helper()
+		if err := dbox.Sync(local, "/s", state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(name string, want string) {
+		t.Helper()
+		if data, err := ioutil.ReadFile(filepath.Join(local, name)); err != nil || string(data) != want {
+			t.Errorf("local %s = %q, %v", name, data, err)
+		}
+		if data, ok := srv.File("/s/" + name); !ok || string(data) != want {
+			t.Errorf("remote %s = %q, %v", name, data, ok)
+		}
+	}
+
+	srv.PutFile("/s/dir/remote.txt", []byte("remote"))
+	srv.PutFile("/s/gone.txt", []byte("gone"))
+	write("local.txt", "local")
+	write("both.txt", "both")
+	sync()
+	check("dir/remote.txt", "remote")
+	check("local.txt", "local")
+	check("both.txt", "both")
+
+	// Nothing changed, nothing is transferred
+	uploads, downloads := srv.Requests("files/upload"), srv.Requests("files/download")
+	sync()
+	if srv.Requests("files/upload") != uploads || srv.Requests("files/download") != downloads {
+		t.Error("a sync without changes transferred files")
+	}
+
+	// One change on each side
+	write("local.txt", "local edit")
+	srv.PutFile("/s/dir/remote.txt", []byte("remote edit"))
+	os.Remove(filepath.Join(local, "gone.txt"))
+	dbox.Delete("/s/both.txt")
+	sync()
+	check("local.txt", "local edit")
+	check("dir/remote.txt", "remote edit")
+	if srv.Exists("/s/gone.txt") {
+		t.Error("file deleted locally was not deleted remotely")
+	}
+	if _, err := os.Stat(filepath.Join(local, "both.txt")); !os.IsNotExist(err) {
+		t.Error("file deleted remotely was not deleted locally")
+	}
+
+	// Changes on both sides keep both versions
+	write("local.txt", "mine")
+	srv.PutFile("/s/local.txt", []byte("theirs"))
+	sync()
+	check("local.txt", "theirs")
+	check("local (conflicted copy "+time.Now().Format("2006-01-02")+").txt", "mine")
+
+	// The state survives a reload
+	state, err = LoadSyncState(state.path)
+	if err != nil || len(state.Files) != 3 {
+		t.Fatalf("reloaded state has %d files, %v", len(state.Files), err)
+	}
+	uploads = srv.Requests("files/upload")
+	sync()
+	if srv.Requests("files/upload") != uploads {
+		t.Error("a sync with a reloaded state uploaded files")
+	}
+}
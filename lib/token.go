@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+)
+
+// kRefreshMargin is how long before its expiry an access token is
+// refreshed, so requests in flight do not fail with it.
+const kRefreshMargin = 5 * time.Minute
+
+// TokenStore keeps the token of a Dropbox where other processes sharing
+// it see refreshes.
+type TokenStore interface {
+	// Update calls refresh with the stored token, holding a lock other
+	// processes respect, and stores the token it returns.
+	Update(refresh func(stored Token) (Token, error)) (Token, error)
+}
+
+// Expiring reports whether the access token expires within d.
+func (t *Token) Expiring(d time.Duration) bool {
+	return !t.Expiry.IsZero() && time.Until(t.Expiry) < d
+}
+
+// token returns Token, safe while requests refresh it.
+func (dbox *Dropbox) token() Token {
+	dbox.token_mu.Lock()
+	defer dbox.token_mu.Unlock()
+	return dbox.Token
+}
+
+func (dbox *Dropbox) setToken(token Token) {
+	dbox.token_mu.Lock()
+	defer dbox.token_mu.Unlock()
+	dbox.Token = token
+}
+
+// canRefresh reports whether the access token can be refreshed.
+func (dbox *Dropbox) canRefresh(token Token) bool {
+	return token.RefreshToken != "" && dbox.AppKey != ""
+}
+
+// Refresh gets a new access token with the refresh token.
+func (dbox *Dropbox) Refresh() error {
+	return dbox.RefreshContext(context.Background())
+}
+
+// RefreshContext is Refresh with a context.
+func (dbox *Dropbox) RefreshContext(ctx context.Context) error {
+	return dbox.refresh(ctx, dbox.token().AccessToken)
+}
+
+// refresh replaces the access token used, unless another request or,
+// through Store, another process already did.
+func (dbox *Dropbox) refresh(ctx context.Context, used string) error {
+	dbox.token_mu.Lock()
+	defer dbox.token_mu.Unlock()
+	if dbox.Token.AccessToken != used {
+		return nil
+	}
+	if !dbox.canRefresh(dbox.Token) {
+		return errors.New("dropbox: access token expired and there is no refresh token, log in again")
+	}
+	refresh := func(stored Token) (Token, error) {
+		if stored.RefreshToken == "" {
+			stored = dbox.Token
+		} else if stored.AccessToken != used && !stored.Expiring(kRefreshMargin) {
+			return stored, nil
+		}
+		parm := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {stored.RefreshToken}, "client_id": {dbox.AppKey}}
+		token, err := dbox.postToken(ctx, parm)
+		if err != nil {
+			return Token{}, err
+		}
+		// The refresh token is only sent again when it is rotated
+		if token.RefreshToken == "" {
+			token.RefreshToken = stored.RefreshToken
+		}
+		if token.AccountId == "" {
+			token.AccountId, token.Uid = stored.AccountId, stored.Uid
+		}
+		return token, nil
+	}
+	var (
+		token Token
+		err   error
+	)
+	if dbox.Store != nil {
+		token, err = dbox.Store.Update(refresh)
+	} else {
+		token, err = refresh(dbox.Token)
+	}
+	if err != nil {
+		return err
+	}
+	dbox.Token = token
+	return nil
+}
+
+// Revoke disables the access token, and on Dropbox the refresh token it
+// was got with, then forgets Token.
+func (dbox *Dropbox) Revoke() error {
+	return dbox.RevokeContext(context.Background())
+}
+
+// RevokeContext is Revoke with a context.
+func (dbox *Dropbox) RevokeContext(ctx context.Context) error {
+	if err := dbox.rpc(ctx, "auth/token/revoke", nil, nil); err != nil {
+		return err
+	}
+	dbox.setToken(Token{})
+	return nil
+}
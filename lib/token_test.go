@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/isyangban/gdbox/lib/dboxtest"
+)
+
+// login gets a token with a refresh token from the fake server.
+func login(t *testing.T, dbox *Dropbox, srv *dboxtest.Server) {
+	t.Helper()
+	pkce, _ := NewPKCE()
+	code := srv.Authorize("app", pkce.Challenge, "")
+	if err := dbox.ExchangeCode("app", code, "", pkce.Verifier); err != nil {
+		t.Fatal(err)
+	}
+	if dbox.Token.RefreshToken == "" || dbox.Token.Expiry.IsZero() {
+		t.Fatalf("login token %+v", dbox.Token)
+	}
+}
+
+// memoryStore is a TokenStore shared by clients, like a config file
+// shared by processes.
+type memoryStore struct {
+	mu      sync.Mutex
+	token   Token
+	updates int
+}
+
+func (s *memoryStore) Update(refresh func(Token) (Token, error)) (Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, err := refresh(s.token)
+	if err == nil {
+		s.token = token
+		s.updates++
+	}
+	return token, err
+}
+
+func TestRefresh(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	login(t, dbox, srv)
+	srv.PutFile("/a.txt", nil)
+
+	// Refused as expired: refreshed once and sent again
+	srv.ExpireTokens()
+	old := dbox.Token.AccessToken
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := dbox.Stat("/a.txt"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if dbox.Token.AccessToken == old || dbox.Token.RefreshToken == "" {
+		t.Errorf("token after refresh %+v", dbox.Token)
+	}
+	if n := srv.Requests("oauth2/token"); n != 2 {
+		t.Errorf("%d token requests, want a login and one refresh", n)
+	}
+
+	// About to expire: refreshed before the request
+	dbox.Token.Expiry = time.Now().Add(time.Minute)
+	calls := srv.Requests("users/get_current_account")
+	if _, err := dbox.GetAccount(); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Requests("oauth2/token") != 3 || srv.Requests("users/get_current_account") != calls+1 {
+		t.Error("expiring token was not refreshed before the request")
+	}
+
+	// Rotated refresh tokens replace the old one
+	srv.RotateRefreshTokens = true
+	refresh_token := dbox.Token.RefreshToken
+	if err := dbox.Refresh(); err != nil || dbox.Token.RefreshToken == refresh_token {
+		t.Errorf("Refresh = %v, refresh token %q", err, dbox.Token.RefreshToken)
+	}
+
+	// A revoked refresh token fails the request
+	dbox.Token.RefreshToken = "revoked"
+	srv.ExpireTokens()
+	if _, err := dbox.GetAccount(); err == nil {
+		t.Error("request succeeded with a revoked refresh token")
+	}
+	// Without a refresh token the 401 is returned as is
+	dbox.Token = Token{AccessToken: "token-1"}
+	if _, err := dbox.GetAccount(); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("expired token without refresh = %v", err)
+	}
+}
+
+func TestRefreshStore(t *testing.T) {
+	srv, a := newTestDropbox(t)
+	srv.RotateRefreshTokens = true
+	login(t, a, srv)
+	store := &memoryStore{token: a.Token}
+	a.Store = store
+	_, b := newTestDropbox(t)
+	b.ApiHost, b.AppKey, b.Token, b.Store = srv.URL, "app", a.Token, store
+
+	// a refreshes and rotates the refresh token, b takes the stored token
+	// instead of refreshing with the old one
+	srv.ExpireTokens()
+	if _, err := a.GetAccount(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetAccount(); err != nil {
+		t.Fatal(err)
+	}
+	if b.Token != a.Token || store.token != a.Token {
+		t.Errorf("b has %+v, a %+v, store %+v", b.Token, a.Token, store.token)
+	}
+	if n := srv.Requests("oauth2/token"); n != 2 {
+		t.Errorf("%d token requests, want a login and one refresh", n)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	login(t, dbox, srv)
+	token := dbox.Token
+	if err := dbox.Revoke(); err != nil {
+		t.Fatal(err)
+	}
+	if dbox.Token != (Token{}) {
+		t.Errorf("token after revoke %+v", dbox.Token)
+	}
+	// Without its refresh token, so the revoked token is not replaced
+	token.RefreshToken = ""
+	dbox.Token = token
+	if _, err := dbox.GetAccount(); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("revoked token: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Transfer is one file to upload or download. Run returns what it did
+// when that is worth reporting, such as "skipped", or "" when it simply
+// succeeded.
+type Transfer struct {
+	Name string
+	Run  func(ctx context.Context) (string, error)
+}
+
+// TransferResult is the outcome of a Transfer.
+type TransferResult struct {
+	Name    string
+	Outcome string
+	Err     error
+}
+
+// TransferError lists the transfers that failed in a RunTransfers call.
+type TransferError struct {
+	Failed []TransferResult
+	Total  int
+}
+
+func (e *TransferError) Error() string {
+	if len(e.Failed) == 1 {
+		return fmt.Sprintf("1 of %d transfers failed: %v", e.Total, e.Failed[0].Err)
+	}
+	return fmt.Sprintf("%d of %d transfers failed", len(e.Failed), e.Total)
+}
+
+// Unwrap makes errors.Is and errors.As look at every failed transfer.
+func (e *TransferError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, result := range e.Failed {
+		errs[i] = result.Err
+	}
+	return errs
+}
+
+// RunTransfers runs transfers on at most workers goroutines. report is
+// called for each transfer in the order of transfers, once it and all
+// the transfers before it are done, so progress output does not depend
+// on scheduling. Transfers not started when ctx is done fail with
+// ctx.Err(). The error is a *TransferError when any transfer failed.
+func RunTransfers(ctx context.Context, transfers []Transfer, workers int, report func(TransferResult)) error {
+	return StreamTransfers(ctx, func(add func(Transfer) error) error {
+		for _, transfer := range transfers {
+			add(transfer)
+		}
+		return nil
+	}, workers, report)
+}
+
+// StreamTransfers is RunTransfers for transfers listed on the fly, such
+// as the files of a folder walk. list calls add for each transfer; add
+// waits while the workers are busy, so only a few transfers are held at
+// a time, and returns ctx.Err() so the listing can stop. An error of
+// list is returned once the transfers added before it are done.
+func StreamTransfers(ctx context.Context, list func(add func(Transfer) error) error, workers int, report func(TransferResult)) error {
+	if workers < 1 {
+		workers = 1
+	}
+	type job struct {
+		transfer Transfer
+		result   chan TransferResult
+	}
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				result := TransferResult{Name: j.transfer.Name, Err: ctx.Err()}
+				if result.Err == nil {
+					result.Outcome, result.Err = j.transfer.Run(ctx)
+				}
+				j.result <- result
+			}
+		}()
+	}
+
+	// Results are reported in the order the transfers were added
+	pending := make(chan chan TransferResult, workers)
+	transfer_err := &TransferError{}
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		for result_ch := range pending {
+			result := <-result_ch
+			transfer_err.Total++
+			if result.Err != nil {
+				transfer_err.Failed = append(transfer_err.Failed, result)
+			}
+			if report != nil {
+				report(result)
+			}
+		}
+	}()
+	list_err := list(func(transfer Transfer) error {
+		result := make(chan TransferResult, 1)
+		pending <- result
+		jobs <- job{transfer, result}
+		return ctx.Err()
+	})
+	close(jobs)
+	close(pending)
+	<-reported
+	wg.Wait()
+	if list_err != nil {
+		return list_err
+	}
+	if len(transfer_err.Failed) > 0 {
+		return transfer_err
+	}
+	return nil
+}
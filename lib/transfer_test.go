@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunTransfers(t *testing.T) {
+	var running, most int32
+	var transfers []Transfer
+	for i := 0; i < 20; i++ {
+		i := i
+		transfers = append(transfers, Transfer{
+			Name: fmt.Sprint(i),
+			Run: func(ctx context.Context) (string, error) {
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				for {
+					m := atomic.LoadInt32(&most)
+					if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+						break
+					}
+				}
+				// later transfers finish first
+				time.Sleep(time.Duration(20-i) * time.Millisecond)
+				if i%5 == 0 {
+					return "", ErrNotFound
+				}
+				return "", nil
+			},
+		})
+	}
+
+	var reported []string
+	err := RunTransfers(context.Background(), transfers, 4, func(result TransferResult) {
+		reported = append(reported, result.Name)
+	})
+	for i, name := range reported {
+		if name != fmt.Sprint(i) {
+			t.Fatalf("reported out of order: %v", reported)
+		}
+	}
+	if len(reported) != 20 {
+		t.Errorf("reported %d transfers, want 20", len(reported))
+	}
+	if most > 4 || most < 2 {
+		t.Errorf("%d transfers ran at once, want 2 to 4", most)
+	}
+	var transfer_err *TransferError
+	if !errors.As(err, &transfer_err) || len(transfer_err.Failed) != 4 || transfer_err.Total != 20 {
+		t.Fatalf("RunTransfers = %v", err)
+	}
+	if !errors.Is(err, ErrNotFound) || transfer_err.Failed[1].Name != "5" {
+		t.Errorf("failed transfers = %v", transfer_err.Failed)
+	}
+}
+
+func TestRunTransfersCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var started int32
+	transfers := make([]Transfer, 10)
+	for i := range transfers {
+		transfers[i].Run = func(ctx context.Context) (string, error) {
+			atomic.AddInt32(&started, 1)
+			cancel()
+			return "", ctx.Err()
+		}
+	}
+	err := RunTransfers(ctx, transfers, 1, nil)
+	if !errors.Is(err, context.Canceled) || started != 1 {
+		t.Errorf("RunTransfers = %v after starting %d transfers", err, started)
+	}
+}
+
+func TestStreamTransfers(t *testing.T) {
+	var added, done, most int32
+	list_err := errors.New("listing failed")
+	var reported int
+	err := StreamTransfers(context.Background(), func(add func(Transfer) error) error {
+		for i := 0; i < 100; i++ {
+			held := atomic.AddInt32(&added, 1) - atomic.LoadInt32(&done)
+			if held > most {
+				most = held
+			}
+			add(Transfer{Name: fmt.Sprint(i), Run: func(ctx context.Context) (string, error) {
+				time.Sleep(time.Millisecond)
+				return "", nil
+			}})
+		}
+		return list_err
+	}, 3, func(result TransferResult) {
+		atomic.AddInt32(&done, 1)
+		if result.Name != fmt.Sprint(reported) {
+			t.Errorf("reported %s as transfer %d", result.Name, reported)
+		}
+		reported++
+	})
+	if err != list_err || reported != 100 {
+		t.Errorf("StreamTransfers = %v after %d transfers", err, reported)
+	}
+	// Added but not reported: one per worker, the reporting window and
+	// the one being added
+	if most > 3+3+2 {
+		t.Errorf("%d transfers were held at once", most)
+	}
+}
@@ -0,0 +1,357 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upload uploads a local file, or every file under a local folder, to
+// remote_path. Files are uploaded with the same relative path under
+// remote_path, but for those Filter ignores.
+func (dbox *Dropbox) Upload(remote_path string, local_path string) error {
+	return dbox.UploadContext(context.Background(), remote_path, local_path)
+}
+
+// UploadContext is Upload with a context.
+func (dbox *Dropbox) UploadContext(ctx context.Context, remote_path string, local_path string) error {
+	return dbox.upload(ctx, remote_path, local_path, false)
+}
+
+// UploadResume is Upload continuing chunked uploads journaled by an
+// earlier run, see UploadJournal. Files that changed since are uploaded
+// from the start.
+func (dbox *Dropbox) UploadResume(remote_path string, local_path string) error {
+	return dbox.UploadResumeContext(context.Background(), remote_path, local_path)
+}
+
+// UploadResumeContext is UploadResume with a context.
+func (dbox *Dropbox) UploadResumeContext(ctx context.Context, remote_path string, local_path string) error {
+	return dbox.upload(ctx, remote_path, local_path, true)
+}
+
+func (dbox *Dropbox) upload(ctx context.Context, remote_path string, local_path string, resume bool) error {
+	stat, err := os.Stat(local_path)
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() && dbox.ExpectedRev != "" {
+		return fmt.Errorf("%s: is a folder, an expected rev is that of a single file", local_path)
+	}
+	policy := dbox.policy(PolicyOverwrite)
+	err = StreamTransfers(ctx, func(add func(Transfer) error) error {
+		return WalkFiles(local_path, dbox.Filter, func(file string, rel string) error {
+			target := apiPath(remote_path)
+			if stat.IsDir() || strings.HasSuffix(remote_path, "/") {
+				target = target + "/" + rel
+			}
+			return add(Transfer{Name: file, Run: func(ctx context.Context) (string, error) {
+				return dbox.uploadWithPolicy(ctx, target, file, policy, resume)
+			}})
+		})
+	}, dbox.Workers, dbox.Report)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// uploadFile uploads a single file and checks the content hash of what
+// was committed, uploading it again when it does not match.
+func (dbox *Dropbox) uploadFile(ctx context.Context, remote_path string, local_path string, mode writeMode, resume bool) (Metadata, error) {
+	var metadata Metadata
+	err := dbox.retryMismatch(ctx, func() (err error) {
+		metadata, err = dbox.sendFile(ctx, remote_path, local_path, mode, resume)
+		if errors.Is(err, ErrHashMismatch) {
+			// Replace what was committed, not another file
+			remote_path, mode.Tag, mode.Rev, mode.Autorename = metadata.Path, "update", metadata.Rev, false
+		}
+		return err
+	})
+	return metadata, err
+}
+
+func (dbox *Dropbox) sendFile(ctx context.Context, remote_path string, local_path string, mode writeMode, resume bool) (Metadata, error) {
+	f, err := os.Open(local_path)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer f.Close()
+	file_stats, err := f.Stat()
+	if err != nil {
+		return Metadata{}, err
+	}
+	mode.ClientModified = file_stats.ModTime()
+	//Use Direct Upload if file size is smaller than DirectUpload Size Limit
+	if file_stats.Size() <= kDboxConst.DirectUploadSizeLimit {
+		body := &hashReader{io.NewSectionReader(f, 0, file_stats.Size()), NewContentHash()}
+		metadata, err := dbox.directUpload(ctx, remote_path, body, mode)
+		if err != nil {
+			return Metadata{}, err
+		}
+		return metadata, checkHash(body.h, metadata, remote_path)
+	}
+	// Chunks may be sent out of order or skipped when resuming, hash the
+	// file on the side while they are sent. The hash stops with the
+	// upload, a failed or canceled one does not wait to read all of it.
+	h := NewContentHash()
+	hashed := make(chan error, 1)
+	hash_ctx, stop_hash := context.WithCancel(ctx)
+	defer stop_hash()
+	go func() {
+		_, err := io.Copy(h, contextReader{hash_ctx, io.NewSectionReader(f, 0, file_stats.Size())})
+		hashed <- err
+	}()
+	chunked_file := dbox.newChunkedFile(remote_path, local_path, file_stats)
+	resumed := false
+	if resume {
+		if journaled, ok := dbox.Journal.load(chunked_file); ok {
+			chunked_file, resumed = journaled, true
+		}
+	}
+	metadata, err := dbox.sendChunks(ctx, f, chunked_file, mode)
+	if resumed && errors.Is(err, ErrNotFound) {
+		// The journaled session is gone, start over
+		chunked_file = dbox.newChunkedFile(remote_path, local_path, file_stats)
+		metadata, err = dbox.sendChunks(ctx, f, chunked_file, mode)
+	}
+	if err != nil {
+		return Metadata{}, err
+	}
+	if err := <-hashed; err != nil {
+		return Metadata{}, err
+	}
+	return metadata, checkHash(h, metadata, remote_path)
+}
+
+// newChunkedFile starts the state of a chunked upload in the session
+// mode set by ChunkWorkers.
+func (dbox *Dropbox) newChunkedFile(remote_path string, local_path string, stat os.FileInfo) *chunkedFile {
+	chunked_file := newChunkedFile(remote_path, local_path, stat)
+	if dbox.ChunkWorkers > 1 {
+		// Every chunk but the last must be aligned
+		chunk_size := dbox.chunkSize() / kDboxConst.ChunkAlign * kDboxConst.ChunkAlign
+		if chunk_size == 0 {
+			chunk_size = kDboxConst.ChunkAlign
+		}
+		chunked_file.Concurrent, chunked_file.ChunkSize = true, chunk_size
+	}
+	return chunked_file
+}
+
+func (dbox *Dropbox) chunkSize() int64 {
+	if dbox.ChunkSize > 0 {
+		return dbox.ChunkSize
+	}
+	return kDboxConst.DirectUploadSizeLimit
+}
+
+// sendChunks appends the rest of f to the session of chunked_file,
+// starting one if needed, and journals the progress after every chunk.
+// The session is committed once everything was sent and the metadata
+// of the new file returned.
+func (dbox *Dropbox) sendChunks(ctx context.Context, f *os.File, chunked_file *chunkedFile, mode writeMode) (Metadata, error) {
+	if chunked_file.Concurrent {
+		return dbox.sendConcurrentChunks(ctx, f, chunked_file, mode)
+	}
+	for chunked_file.Offset < chunked_file.Size {
+		chunk_size := dbox.chunkSize()
+		if rest := chunked_file.Size - chunked_file.Offset; rest < chunk_size {
+			chunk_size = rest
+		}
+		sf := io.NewSectionReader(f, chunked_file.Offset, chunk_size)
+		upload_id, offset, err := dbox.chunkedUpload(ctx, chunked_file.UploadId, sf, chunked_file.Offset)
+		if correct, ok := correctOffset(err); ok && correct <= chunked_file.Size {
+			// The journal lagged behind the server, continue where it is
+			offset, err = correct, nil
+		}
+		if err != nil {
+			return Metadata{}, err
+		}
+		if chunked_file.UploadId == "" {
+			chunked_file.Expires = time.Now().Add(kSessionLifetime)
+		}
+		chunked_file.UploadId, chunked_file.Offset = upload_id, offset
+		if err := dbox.Journal.save(chunked_file); err != nil {
+			return Metadata{}, err
+		}
+	}
+	metadata, err := dbox.commitChunkedUpload(ctx, chunked_file.RemotePath, chunked_file.UploadId, chunked_file.Offset, mode)
+	if err == nil {
+		dbox.Journal.remove(chunked_file)
+	}
+	return metadata, err
+}
+
+// sendConcurrentChunks uploads the chunks of f not yet in
+// chunked_file.Done on up to ChunkWorkers goroutines. The last chunk
+// closes the session, so it is sent once all the others arrived, and
+// the session is committed after it.
+func (dbox *Dropbox) sendConcurrentChunks(ctx context.Context, f *os.File, chunked_file *chunkedFile, mode writeMode) (Metadata, error) {
+	if chunked_file.UploadId == "" {
+		parm := map[string]interface{}{"close": false, "session_type": "concurrent"}
+		resp, err := dbox.content(ctx, "files/upload_session/start", parm, bytes.NewReader(nil))
+		if err != nil {
+			return Metadata{}, err
+		}
+		err = json.NewDecoder(resp.Body).Decode(chunked_file)
+		resp.Body.Close()
+		if err != nil {
+			return Metadata{}, err
+		}
+		chunked_file.Expires = time.Now().Add(kSessionLifetime)
+		if err := dbox.Journal.save(chunked_file); err != nil {
+			return Metadata{}, err
+		}
+	}
+	done := make(map[int64]bool)
+	for _, offset := range chunked_file.Done {
+		done[offset] = true
+	}
+	var mu sync.Mutex // guards chunked_file.Done and the journal
+	send := func(ctx context.Context, offset int64, chunk_size int64, close bool) error {
+		parm := map[string]interface{}{"cursor": uploadCursor{chunked_file.UploadId, offset}, "close": close}
+		resp, err := dbox.content(ctx, "files/upload_session/append_v2", parm, io.NewSectionReader(f, offset, chunk_size))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		chunked_file.Done = append(chunked_file.Done, offset)
+		return dbox.Journal.save(chunked_file)
+	}
+	last := (chunked_file.Size - 1) / chunked_file.ChunkSize * chunked_file.ChunkSize
+	var chunks []Transfer
+	for offset := int64(0); offset < last; offset += chunked_file.ChunkSize {
+		if offset := offset; !done[offset] {
+			chunks = append(chunks, Transfer{Run: func(ctx context.Context) (string, error) {
+				return "", send(ctx, offset, chunked_file.ChunkSize, false)
+			}})
+		}
+	}
+	if err := RunTransfers(ctx, chunks, dbox.ChunkWorkers, nil); err != nil {
+		if ctx.Err() != nil {
+			return Metadata{}, ctx.Err()
+		}
+		return Metadata{}, err.(*TransferError).Failed[0].Err
+	}
+	if !done[last] {
+		if err := send(ctx, last, chunked_file.Size-last, true); err != nil {
+			return Metadata{}, err
+		}
+	}
+	metadata, err := dbox.commitChunkedUpload(ctx, chunked_file.RemotePath, chunked_file.UploadId, chunked_file.Size, mode)
+	if err == nil {
+		dbox.Journal.remove(chunked_file)
+	}
+	return metadata, err
+}
+
+// writeMode is how an upload is committed: Tag is "add", "overwrite" or
+// "update", which only replaces the file at Rev. Autorename saves the
+// file under a free name instead of failing on a conflict.
+// ClientModified is the modification time of the local file.
+type writeMode struct {
+	Tag            string
+	Rev            string
+	Autorename     bool
+	ClientModified time.Time
+}
+
+func commitInfo(remote_path string, mode writeMode) map[string]interface{} {
+	var tag interface{} = mode.Tag
+	if mode.Tag == "update" {
+		tag = map[string]interface{}{".tag": "update", "update": mode.Rev}
+	}
+	info := map[string]interface{}{"path": remote_path, "mode": tag, "autorename": mode.Autorename, "mute": false}
+	if !mode.ClientModified.IsZero() {
+		info["client_modified"] = mode.ClientModified.UTC().Format(time.RFC3339)
+	}
+	return info
+}
+
+func (dbox *Dropbox) directUpload(ctx context.Context, remote_path string, f io.ReadSeeker, mode writeMode) (Metadata, error) {
+	resp, err := dbox.content(ctx, "files/upload", commitInfo(remote_path, mode), f)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer resp.Body.Close()
+	var metadata Metadata
+	err = json.NewDecoder(resp.Body).Decode(&metadata)
+	return metadata, err
+}
+
+type uploadCursor struct {
+	SessionId string `json:"session_id"`
+	Offset    int64  `json:"offset"`
+}
+
+// chunkedUpload starts a new upload session when upload_id is empty,
+// otherwise appends sf at offset. It returns the session id and the
+// offset after the appended chunk.
+func (dbox *Dropbox) chunkedUpload(ctx context.Context, upload_id string, sf *io.SectionReader, offset int64) (string, int64, error) {
+	var (
+		resp *http.Response
+		err  error
+	)
+	if upload_id == "" {
+		resp, err = dbox.content(ctx, "files/upload_session/start", map[string]interface{}{"close": false}, sf)
+	} else {
+		parm := map[string]interface{}{"cursor": uploadCursor{upload_id, offset}, "close": false}
+		resp, err = dbox.content(ctx, "files/upload_session/append_v2", parm, sf)
+		// A retried append whose first try did reach the server
+		if correct, ok := correctOffset(err); ok && correct == offset+sf.Size() {
+			return upload_id, correct, nil
+		}
+	}
+	if err != nil {
+		return upload_id, offset, err
+	}
+	defer resp.Body.Close()
+	if upload_id == "" {
+		chunked_file := new(chunkedFile)
+		if err := json.NewDecoder(resp.Body).Decode(chunked_file); err != nil {
+			return "", offset, err
+		}
+		upload_id = chunked_file.UploadId
+	}
+	return upload_id, offset + sf.Size(), nil
+}
+
+// correctOffset returns the offset the server expects when err is an
+// incorrect_offset upload session error.
+func correctOffset(err error) (int64, bool) {
+	var api_err *APIError
+	if !errors.As(err, &api_err) || !api_err.HasTag("incorrect_offset") {
+		return 0, false
+	}
+	var detail struct {
+		CorrectOffset int64 `json:"correct_offset"`
+		LookupFailed  struct {
+			CorrectOffset int64 `json:"correct_offset"`
+		} `json:"lookup_failed"`
+	}
+	json.Unmarshal(api_err.Detail, &detail)
+	return detail.CorrectOffset + detail.LookupFailed.CorrectOffset, true
+}
+
+func (dbox *Dropbox) commitChunkedUpload(ctx context.Context, remote_path string, upload_id string, offset int64, mode writeMode) (Metadata, error) {
+	parm := map[string]interface{}{"cursor": uploadCursor{upload_id, offset}, "commit": commitInfo(remote_path, mode)}
+	resp, err := dbox.content(ctx, "files/upload_session/finish", parm, bytes.NewReader(nil))
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer resp.Body.Close()
+	var metadata Metadata
+	err = json.NewDecoder(resp.Body).Decode(&metadata)
+	return metadata, err
+}
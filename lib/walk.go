@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// WalkFunc is called by Walk for each entry of a remote tree. Returning
+// filepath.SkipDir for a folder skips what is in it, and is ignored for
+// a file. Any other error stops the walk and is returned by Walk.
+type WalkFunc func(entry Metadata) error
+
+// Walk calls fn for every file and folder under root, not root itself,
+// or only for root when it is a file. Entries are streamed as they are
+// listed, so trees of any size are walked in bounded memory. A folder
+// comes before what is in it, the order is otherwise not sorted. With
+// ListWorkers above 1, folders are listed one at a time on that many
+// goroutines, which is faster for wide trees and does not list skipped
+// folders; otherwise the tree is listed in one recursive listing, which
+// Cache keeps. A recursive listing the server fails on before it
+// returned anything is retried folder by folder.
+func (dbox *Dropbox) Walk(root string, fn WalkFunc) error {
+	return dbox.WalkContext(context.Background(), root, fn)
+}
+
+// WalkContext is Walk with a context.
+func (dbox *Dropbox) WalkContext(ctx context.Context, root string, fn WalkFunc) error {
+	var err error
+	if dbox.ListWorkers > 1 {
+		err = dbox.walkFolders(ctx, root, fn)
+	} else if err = dbox.walkRecursive(ctx, root, fn); errors.Is(err, errRecursiveFailed) {
+		err = dbox.walkFolders(ctx, root, fn)
+	}
+	var api_err *APIError
+	if errors.As(err, &api_err) && api_err.HasTag("not_folder") {
+		// A file is walked as itself
+		entry, err := dbox.StatContext(ctx, root)
+		if err != nil {
+			return err
+		}
+		if err = fn(entry); err == filepath.SkipDir {
+			err = nil
+		}
+		return err
+	}
+	return err
+}
+
+// errRecursiveFailed is returned by walkRecursive when the server failed
+// the listing before any entry was walked.
+var errRecursiveFailed = errors.New("recursive listing failed")
+
+func (dbox *Dropbox) walkRecursive(ctx context.Context, root string, fn WalkFunc) error {
+	// Lower case paths of the skipped folders, with a trailing slash
+	var skipped []string
+	walked := false
+	visit := func(entry Metadata) error {
+		walked = true
+		lower := strings.ToLower(entry.Path)
+		for _, dir := range skipped {
+			if strings.HasPrefix(lower, dir) {
+				return nil
+			}
+		}
+		err := fn(entry)
+		if err == filepath.SkipDir {
+			if entry.IsDir {
+				skipped = append(skipped, lower+"/")
+			}
+			err = nil
+		}
+		return err
+	}
+	if listing, ok := dbox.cachedTree(ctx, root); ok {
+		for _, entry := range listing.Entries {
+			if err := visit(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Collected for the cache as long as it fits
+	listing := &cachedListing{Path: apiPath(root), Recursive: true}
+	collect := dbox.Cache != nil
+	cursor, err := dbox.listFolder(ctx, root, true, func(entry Metadata) error {
+		if collect = collect && dbox.Cache.fits(len(listing.Entries)+1); collect {
+			listing.Entries = append(listing.Entries, entry)
+		} else {
+			listing.Entries = nil
+		}
+		return visit(entry)
+	})
+	if !walked && errors.Is(err, ErrServer) {
+		return errRecursiveFailed
+	}
+	if err == nil && collect {
+		listing.Cursor = cursor
+		dbox.Cache.save(listing)
+	}
+	return err
+}
+
+// cachedTree returns the cached recursive listing of root brought up to
+// date, if root is still a folder.
+func (dbox *Dropbox) cachedTree(ctx context.Context, root string) (*cachedListing, bool) {
+	listing, ok := dbox.Cache.load(root, true)
+	if !ok {
+		return nil, false
+	}
+	// The changes of a deleted root would make it an empty folder
+	if metadata, err := dbox.StatContext(ctx, root); err != nil || !metadata.IsDir {
+		return nil, false
+	}
+	changed, err := dbox.update(ctx, listing)
+	if err != nil {
+		return nil, false
+	}
+	if changed {
+		dbox.Cache.save(listing)
+	}
+	return listing, true
+}
+
+// walkFolders lists the folders of a tree on ListWorkers goroutines and
+// calls fn for the entries as they come.
+func (dbox *Dropbox) walkFolders(ctx context.Context, root string, fn WalkFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	workers := dbox.ListWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	// A listed entry, or the end of the listing of folder when done
+	type walkEntry struct {
+		entry  Metadata
+		done   bool
+		folder string
+		err    error
+	}
+	entries := make(chan walkEntry)
+	var wg sync.WaitGroup
+	list := func(folder string) {
+		defer wg.Done()
+		err := dbox.ListFolderContext(ctx, folder, false, func(entry Metadata) error {
+			select {
+			case entries <- walkEntry{entry: entry}:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		select {
+		case entries <- walkEntry{done: true, folder: folder, err: err}:
+		case <-ctx.Done():
+		}
+	}
+
+	queue := []string{root}
+	running := 0
+	var err error
+	for err == nil && (len(queue) > 0 || running > 0) {
+		for running < workers && len(queue) > 0 {
+			wg.Add(1)
+			running++
+			go list(queue[0])
+			queue = queue[1:]
+		}
+		var walk_entry walkEntry
+		select {
+		case walk_entry = <-entries:
+		case <-ctx.Done():
+			err = ctx.Err()
+			continue
+		}
+		if walk_entry.done {
+			running--
+			err = walk_entry.err
+			continue
+		}
+		err = fn(walk_entry.entry)
+		if err == nil && walk_entry.entry.IsDir {
+			queue = append(queue, walk_entry.entry.Path)
+		} else if err == filepath.SkipDir {
+			err = nil
+		}
+	}
+	cancel()
+	wg.Wait()
+	return err
+}
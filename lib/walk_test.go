@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PageLimit = 2
+	for _, name := range []string{"/w/a.txt", "/w/b/c.txt", "/w/b/d/e.txt", "/w/skip/f.txt", "/w/skip/g/h.txt"} {
+		srv.PutFile(name, nil)
+	}
+	walk := func(root string) ([]string, error) {
+		var paths []string
+		err := dbox.Walk(root, func(entry Metadata) error {
+			for _, seen := range paths {
+				if strings.HasPrefix(seen, entry.Path+"/") {
+					t.Errorf("%s came after %s", entry.Path, seen)
+				}
+			}
+			paths = append(paths, entry.Path)
+			if entry.Name == "skip" {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		sort.Strings(paths)
+		return paths, err
+	}
+	want := "/w/a.txt /w/b /w/b/c.txt /w/b/d /w/b/d/e.txt /w/skip"
+	for _, workers := range []int{1, 4} {
+		dbox.ListWorkers = workers
+		listings := srv.Requests("files/list_folder")
+		paths, err := walk("/w")
+		if err != nil || strings.Join(paths, " ") != want {
+			t.Errorf("%d workers: Walk = %v, %v", workers, paths, err)
+		}
+		// Folder by folder, the skipped one is not listed
+		if got := srv.Requests("files/list_folder") - listings; workers > 1 && got != 3 {
+			t.Errorf("%d workers: %d folders listed, want 3", workers, got)
+		}
+	}
+
+	// A failed recursive listing is retried folder by folder
+	dbox.ListWorkers = 1
+	srv.FailNext("files/list_folder", 500, dbox.MaxTries)
+	if paths, err := walk("/w"); err != nil || strings.Join(paths, " ") != want {
+		t.Errorf("Walk after a failed recursive listing = %v, %v", paths, err)
+	}
+
+	if paths, err := walk("/w/a.txt"); err != nil || len(paths) != 1 || paths[0] != "/w/a.txt" {
+		t.Errorf("Walk of a file = %v, %v", paths, err)
+	}
+	if _, err := walk("/missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Walk of a missing folder = %v", err)
+	}
+	stop := errors.New("stop")
+	for _, workers := range []int{1, 4} {
+		dbox.ListWorkers = workers
+		calls := 0
+		err := dbox.Walk("/w", func(entry Metadata) error {
+			calls++
+			return stop
+		})
+		if err != stop || calls != 1 {
+			t.Errorf("%d workers: Walk = %v after %d calls", workers, err, calls)
+		}
+	}
+}
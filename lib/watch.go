@@ -0,0 +1,222 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// kLongpollTimeout is the longest a longpoll waits for changes, the
+// most the api accepts.
+const kLongpollTimeout = 480 * time.Second
+
+// Types of WatchEvent
+const (
+	WatchAdded    = "added"
+	WatchModified = "modified"
+	WatchDeleted  = "deleted"
+)
+
+// WatchEvent is a change Watch saw under its root. Entry is the
+// metadata of the file or folder, only its paths and name are set when
+// it was deleted.
+type WatchEvent struct {
+	Type  string   `json:"event"`
+	Path  string   `json:"path"`
+	Entry Metadata `json:"metadata"`
+}
+
+type longpollResult struct {
+	Changes bool `json:"changes"`
+	Backoff int  `json:"backoff"`
+}
+
+// Longpoll waits up to timeout for a change under the folder a cursor
+// was got for, and reports whether there was one. backoff is how long
+// the server asks to wait before the next longpoll. It is sent to
+// NotifyHost without the access token.
+func (dbox *Dropbox) Longpoll(cursor string, timeout time.Duration) (changes bool, backoff time.Duration, err error) {
+	return dbox.LongpollContext(context.Background(), cursor, timeout)
+}
+
+// LongpollContext is Longpoll with a context.
+func (dbox *Dropbox) LongpollContext(ctx context.Context, cursor string, timeout time.Duration) (bool, time.Duration, error) {
+	body, err := json.Marshal(map[string]interface{}{"cursor": cursor, "timeout": int(timeout / time.Second)})
+	if err != nil {
+		return false, 0, err
+	}
+	resp, err := dbox.do(ctx, "files/list_folder/longpoll", func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", endpointURL(dbox.NotifyHost, "2/files/list_folder/longpoll"), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	defer resp.Body.Close()
+	var result longpollResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, 0, err
+	}
+	return result.Changes, time.Duration(result.Backoff) * time.Second, nil
+}
+
+// Watch calls fn for every file and folder added, modified or deleted
+// under the folder root, in the order Dropbox reports them, until fn
+// fails. The tree is listed once to know what is in it, then changes are
+// waited for with Longpoll and read from the cursor of the listing.
+// Requests that still fail after MaxTries are tried again after a
+// backoff, and an expired cursor is replaced by listing the tree again
+// and reporting what changed in the meantime.
+func (dbox *Dropbox) Watch(root string, fn func(WatchEvent) error) error {
+	return dbox.WatchContext(context.Background(), root, fn)
+}
+
+// WatchContext is Watch with a context, it watches until ctx is done.
+func (dbox *Dropbox) WatchContext(ctx context.Context, root string, fn func(WatchEvent) error) error {
+	w := &watcher{dbox: dbox, root: root, fn: fn, known: make(map[string]string)}
+	cursor, err := w.list(ctx, false)
+	if err != nil {
+		return err
+	}
+	for try := 1; ; {
+		changes, wait, err := dbox.LongpollContext(ctx, cursor, kLongpollTimeout)
+		if err == nil && changes {
+			cursor, err = w.update(ctx, cursor)
+		}
+		var api_err *APIError
+		if errors.As(err, &api_err) && api_err.HasTag("reset") {
+			var list_cursor string
+			if list_cursor, err = w.list(ctx, true); err == nil {
+				cursor = list_cursor
+			}
+		}
+		switch {
+		case w.err != nil:
+			return w.err
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.As(err, &api_err) && api_err.StatusCode < 500 && api_err.StatusCode != 429:
+			// Retrying will not help a bad request or token
+			return err
+		case err != nil:
+			if wait < backoff(try) {
+				wait = backoff(try)
+			}
+			try++
+		default:
+			try = 1
+		}
+		if wait > 0 {
+			if err := dbox.sleep(ctx, wait); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// watcher keeps what Watch knows of a tree.
+type watcher struct {
+	dbox  *Dropbox
+	root  string
+	fn    func(WatchEvent) error
+	known map[string]string // rev by lower case path, "" for folders
+	err   error             // returned by fn
+}
+
+// list lists the tree, reporting the difference with what was known
+// when report is set, and returns the cursor of the listing.
+func (w *watcher) list(ctx context.Context, report bool) (string, error) {
+	seen := make(map[string]bool)
+	cursor, err := w.dbox.listFolder(ctx, w.root, true, func(entry Metadata) error {
+		seen[entry.PathLower] = true
+		return w.apply(entry, report)
+	})
+	if err != nil {
+		return "", err
+	}
+	var deleted []string
+	for lower := range w.known {
+		if !seen[lower] {
+			deleted = append(deleted, lower)
+		}
+	}
+	// Contents before their folder, as Dropbox reports deletions
+	sort.Sort(sort.Reverse(sort.StringSlice(deleted)))
+	for _, lower := range deleted {
+		entry := Metadata{Tag: "deleted", Name: path.Base(lower), Path: lower, PathLower: lower}
+		if err := w.apply(entry, report); err != nil {
+			return "", err
+		}
+	}
+	return cursor, nil
+}
+
+// update reads the changes since cursor and returns the cursor after
+// them. On failure it returns the cursor after the changes reported.
+func (w *watcher) update(ctx context.Context, cursor string) (string, error) {
+	for {
+		var changes listFolderResult
+		if err := w.dbox.rpc(ctx, "files/list_folder/continue", map[string]interface{}{"cursor": cursor}, &changes); err != nil {
+			return cursor, withPath(err, w.root)
+		}
+		for _, entry := range changes.Entries {
+			if err := w.apply(entry, true); err != nil {
+				return cursor, err
+			}
+		}
+		cursor = changes.Cursor
+		if !changes.HasMore {
+			return cursor, nil
+		}
+	}
+}
+
+// apply records an entry of a listing or of its changes, and calls fn
+// when report is set and the entry differs from what was known.
+func (w *watcher) apply(entry Metadata, report bool) error {
+	lower := entry.PathLower
+	rev, ok := w.known[lower]
+	var event string
+	switch {
+	case entry.Tag == "deleted":
+		// A deleted folder takes its contents with it, Dropbox sends no
+		// deletions for them
+		for known := range w.known {
+			if strings.HasPrefix(known, lower+"/") {
+				delete(w.known, known)
+			}
+		}
+		if !ok {
+			return nil
+		}
+		delete(w.known, lower)
+		event = WatchDeleted
+	case !ok:
+		event = WatchAdded
+	case rev != entry.Rev:
+		event = WatchModified
+	default:
+		return nil
+	}
+	if entry.Tag != "deleted" {
+		w.known[lower] = entry.Rev
+	}
+	if !report {
+		return nil
+	}
+	if err := w.fn(WatchEvent{Type: event, Path: entry.Path, Entry: entry}); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
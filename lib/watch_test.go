@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	srv, dbox := newTestDropbox(t)
+	srv.PutFile("/w/a.txt", []byte("a"))
+	srv.PutFile("/w/b.txt", []byte("b"))
+	srv.PutFile("/other.txt", nil)
+	srv.Backoff = 1
+	var (
+		mu     sync.Mutex
+		sleeps []time.Duration
+	)
+	dbox.sleep = func(ctx context.Context, d time.Duration) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sleeps = append(sleeps, d)
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan WatchEvent)
+	done := make(chan error)
+	go func() {
+		done <- dbox.WatchContext(ctx, "/w", func(event WatchEvent) error {
+			events <- event
+			return nil
+		})
+	}()
+	expect := func(want ...string) {
+		t.Helper()
+		for i := 0; i < len(want); i += 2 {
+			select {
+			case event := <-events:
+				if event.Type != want[i] || event.Path != want[i+1] {
+					t.Errorf("event %s %s, want %s %s", event.Type, event.Path, want[i], want[i+1])
+				}
+			case err := <-done:
+				t.Fatalf("Watch stopped: %v", err)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no event, want %s %s", want[i], want[i+1])
+			}
+		}
+	}
+	// Changes made before the listing are not events
+	for srv.Requests("files/list_folder/longpoll") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	srv.PutFile("/w/c.txt", []byte("c"))
+	expect(WatchAdded, "/w/c.txt")
+	srv.PutFile("/w/a.txt", []byte("edited"))
+	expect(WatchModified, "/w/a.txt")
+	srv.PutFile("/other.txt", []byte("outside"))
+	if _, err := dbox.Delete("/w/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	expect(WatchDeleted, "/w/b.txt")
+
+	// A deleted folder takes its contents with it, what is put back in
+	// its place is new
+	srv.PutFile("/w/sub/x.txt", nil)
+	expect(WatchAdded, "/w/sub", WatchAdded, "/w/sub/x.txt")
+	if _, err := dbox.Delete("/w/sub"); err != nil {
+		t.Fatal(err)
+	}
+	expect(WatchDeleted, "/w/sub")
+	srv.PutFile("/w/sub/x.txt", nil)
+	expect(WatchAdded, "/w/sub", WatchAdded, "/w/sub/x.txt")
+
+	// An expired cursor is replaced, failed longpolls are tried again
+	srv.FailNext("files/list_folder/longpoll", 500, dbox.MaxTries+1)
+	srv.ResetCursors()
+	srv.PutFile("/w/d.txt", nil)
+	expect(WatchAdded, "/w/d.txt")
+	srv.PutFile("/w/e.txt", nil)
+	expect(WatchAdded, "/w/e.txt")
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Watch = %v after cancel", err)
+	}
+	backoff := false
+	for _, d := range sleeps {
+		backoff = backoff || d == time.Second
+	}
+	if !backoff {
+		t.Errorf("backoff hint was not waited for, slept %v", sleeps)
+	}
+
+	if err := dbox.Watch("/missing", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Watch of a missing folder = %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// kDefaultProfile names the account at the top level of the config file,
+// the only one of configs written before profiles.
+const kDefaultProfile = "default"
+
+// Environment variables choosing the profile, and giving an access token
+// that overrides the one of the profile, e.g. in CI
+const (
+	kEnvProfile = "GDBOX_PROFILE"
+	kEnvToken   = "GDBOX_TOKEN"
+)
+
+// kProfile is the profile kConfig was made from, "" for the default one.
+var kProfile string
+
+// profileName picks the profile from the -profile flag, the environment
+// and then the default_profile of the config, "" for the default one.
+func profileName(flag_profile string, c *Config) string {
+	name := flag_profile
+	if name == "" {
+		name = os.Getenv(kEnvProfile)
+	}
+	if name == "" {
+		name = c.DefaultProfile
+	}
+	if name == kDefaultProfile {
+		name = ""
+	}
+	return name
+}
+
+// Profile returns the settings of the profile name. A profile has its
+// own tokens and state folder, and takes the settings it does not set
+// from the top level; its ignore patterns are added to the top level
+// ones. Unknown profiles are an error unless create is set.
+func (c *Config) Profile(name string, create bool) (*Config, error) {
+	profile := *c
+	profile.Profiles, profile.DefaultProfile = nil, ""
+	if name == "" || name == kDefaultProfile {
+		return &profile, nil
+	}
+	section, ok := c.Profiles[name]
+	if !ok && !create {
+		return nil, fmt.Errorf("unknown profile %q, add it with %s profile add %s", name, os.Args[0], name)
+	}
+	if section == nil {
+		section = new(Config)
+	}
+	profile.AccessToken, profile.RefreshToken, profile.TokenExpiry = "", "", 0
+	profile.SealedTokens = nil
+	// Unmarshal would write over the top level ignore patterns
+	profile.StateDir, profile.Ignore = "", nil
+	// Only the settings the profile sets are in its json
+	data, err := json.Marshal(section)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, err
+	}
+	profile.Ignore = append(append([]string(nil), c.Ignore...), section.Ignore...)
+	profile.profile, profile.shared_state = name, c.StateDir
+	return &profile, nil
+}
+
+// section returns the part of the config file holding the profile name,
+// made if it is missing.
+func (c *Config) section(name string) *Config {
+	if name == "" || name == kDefaultProfile {
+		return c
+	}
+	if c.Profiles == nil {
+		c.Profiles = make(map[string]*Config)
+	}
+	if c.Profiles[name] == nil {
+		c.Profiles[name] = new(Config)
+	}
+	return c.Profiles[name]
+}
+
+// profileCommand runs gdbox profile list|add|remove|default [name].
+func profileCommand(args []string) error {
+	if len(args) == 0 || (args[0] == "list") != (len(args) == 1) || len(args) > 2 {
+		return errors.New("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
+	}
+	if args[0] == "list" {
+		var c Config
+		if err := c.LoadFile(kConfigPath); err != nil {
+			return err
+		}
+		printProfiles(&c)
+		return nil
+	}
+	name := args[1]
+	return updateConfig(kConfigPath, func(c *Config) error {
+		_, exists := c.Profiles[name]
+		switch {
+		case name == kDefaultProfile && args[0] != "default":
+			return fmt.Errorf("profile %q is the top level of the config", name)
+		case args[0] == "add":
+			if exists {
+				return fmt.Errorf("profile %q exists", name)
+			}
+			c.section(name)
+			fmt.Printf("Added profile %s, log in with %s -profile %s login\n", name, os.Args[0], name)
+		case !exists && name != kDefaultProfile:
+			return fmt.Errorf("unknown profile %q", name)
+		case args[0] == "remove":
+			delete(c.Profiles, name)
+			if c.DefaultProfile == name {
+				c.DefaultProfile = ""
+			}
+			fmt.Println("Removed profile " + name)
+		case args[0] == "default":
+			c.DefaultProfile = name
+			if name == kDefaultProfile {
+				c.DefaultProfile = ""
+			}
+			fmt.Println("Default profile is now " + name)
+		default:
+			return fmt.Errorf("unknown profile command %q, use list, add, remove or default", args[0])
+		}
+		return nil
+	})
+}
+
+// printProfiles lists the profiles, the default one marked with *.
+func printProfiles(c *Config) {
+	names := []string{kDefaultProfile}
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	default_profile := c.DefaultProfile
+	if default_profile == "" {
+		default_profile = kDefaultProfile
+	}
+	for _, name := range names {
+		mark := " "
+		if name == default_profile {
+			mark = "*"
+		}
+		fmt.Printf("%s %s\t%s\n", mark, name, c.loginState(name))
+	}
+}
+
+// loginState tells whether the profile name of the config file c has
+// tokens.
+func (c *Config) loginState(name string) string {
+	section := c.section(name)
+	if helper := c.credentialHelper(section); helper != "" {
+		// Only the helper knows whether it has them
+		password, err := runCredentialHelper(helper, "get", name, "")
+		switch {
+		case err != nil:
+			return "credential helper failed"
+		case password != "":
+			return "logged in, in the credential helper"
+		}
+		return "not logged in"
+	}
+	if section.AccessToken != "" || section.SealedTokens != nil {
+		return "logged in"
+	}
+	return "not logged in"
+}
+
+// stateDir returns the folder for journals and caches, "" if there is
+// none. Profiles other than the default one keep theirs in a folder of
+// their own.
+func (c *Config) stateDir() string {
+	if c.StateDir != "" {
+		return c.StateDir
+	}
+	dir := c.shared_state
+	if dir == "" {
+		dir = kStateDir
+	}
+	if dir != "" && c.profile != "" {
+		dir = filepath.Join(dir, "profiles", c.profile)
+	}
+	return dir
+}
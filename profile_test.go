@@ -0,0 +1,113 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProfile(t *testing.T) {
+	config := &Config{
+		AccessToken: "personal",
+		ApiHost:     "https://api.example.com",
+		Workers:     4,
+		Ignore:      []string{"*.tmp"},
+		StateDir:    "/state",
+		Profiles: map[string]*Config{
+			"work": {AccessToken: "work", Workers: 8, Ignore: []string{"build/"}},
+			"ci":   {StateDir: "/ci"},
+		},
+	}
+	work, err := config.Profile("work", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if work.AccessToken != "work" || work.Workers != 8 || work.ApiHost != "https://api.example.com" {
+		t.Errorf("work profile %+v", work)
+	}
+	if !reflect.DeepEqual(work.Ignore, []string{"*.tmp", "build/"}) {
+		t.Errorf("work ignores %v", work.Ignore)
+	}
+	if dir := work.stateDir(); dir != filepath.Join("/state", "profiles", "work") {
+		t.Errorf("work state dir %s", dir)
+	}
+
+	// Tokens are not inherited
+	ci, _ := config.Profile("ci", false)
+	if ci.AccessToken != "" || ci.stateDir() != "/ci" || ci.Workers != 4 {
+		t.Errorf("ci profile %+v", ci)
+	}
+	for _, name := range []string{"", kDefaultProfile} {
+		if personal, err := config.Profile(name, false); err != nil || personal.AccessToken != "personal" || personal.stateDir() != "/state" {
+			t.Errorf("profile %q = %+v, %v", name, personal, err)
+		}
+	}
+	if _, err := config.Profile("missing", false); err == nil {
+		t.Error("unknown profile was found")
+	}
+	if _, err := config.Profile("missing", true); err != nil {
+		t.Error(err)
+	}
+
+	t.Setenv(kEnvProfile, "ci")
+	config.DefaultProfile = "work"
+	if name := profileName("", config); name != "ci" {
+		t.Errorf("profile %q, want the environment's", name)
+	}
+	if name := profileName("default", config); name != "" {
+		t.Errorf("profile %q, want the flag's", name)
+	}
+}
+
+func TestProfileCommand(t *testing.T) {
+	newTestServer(t)
+	kConfigPath = filepath.Join(t.TempDir(), "gdbox.conf")
+	defer func() { kConfigPath = "" }()
+	load := func() *Config {
+		t.Helper()
+		var config Config
+		if err := config.LoadFile(kConfigPath); err != nil {
+			t.Fatal(err)
+		}
+		return &config
+	}
+
+	run(t, "", "profile", "add", "work")
+	run(t, "", "profile", "add", "ci")
+	run(t, "", "profile", "default", "work")
+	run(t, "", "profile", "list")
+	if config := load(); len(config.Profiles) != 2 || config.DefaultProfile != "work" {
+		t.Fatalf("after add and default: %+v", config)
+	}
+	run(t, "", "profile", "remove", "work")
+	if config := load(); len(config.Profiles) != 1 || config.DefaultProfile != "" {
+		t.Fatalf("after remove: %+v", config)
+	}
+}
+
+func TestEnvToken(t *testing.T) {
+	config_path := filepath.Join(t.TempDir(), "gdbox.conf")
+	resetPassphrase(t, "secret")
+	encryption, err := newEncryption()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{AccessToken: "stored", Encryption: encryption}
+	if err := config.SaveFile(config_path); err != nil {
+		t.Fatal(err)
+	}
+
+	// No passphrase, the encrypted tokens are not opened
+	resetPassphrase(t, "")
+	t.Setenv(kEnvToken, "ci")
+	c, err := loadConfig(config_path, "", "ls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AccessToken != "ci" {
+		t.Errorf("access token %q, want the one of %s", c.AccessToken, kEnvToken)
+	}
+	if _, err := loadConfig(config_path, "", "logout"); err == nil {
+		t.Errorf("logout with %s set would not revoke the stored tokens", kEnvToken)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Tokens at rest are sealed with AES-256-GCM under a key derived from a
+// passphrase with scrypt, or kept by a git style credential helper.
+
+// kEnvPassphrase gives the passphrase of encrypted tokens without a
+// prompt, e.g. in CI.
+const kEnvPassphrase = "GDBOX_PASSPHRASE"
+
+// scrypt cost of new keys, about 100ms and 32 MiB
+const (
+	kScryptN = 1 << 15
+	kScryptR = 8
+	kScryptP = 1
+)
+
+// kCredentialHost is the host given to credential helpers, the
+// username is the profile.
+const kCredentialHost = "gdbox.dropbox.com"
+
+// tokenEncryption is how the key of sealed tokens is derived.
+type tokenEncryption struct {
+	KDF  string `json:"kdf"`
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+}
+
+// sealedToken is what is sealed for a profile.
+type sealedToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	TokenExpiry  int64  `json:"token_expiry,omitempty"`
+}
+
+// The passphrase and the keys derived from it, asked for once
+var (
+	kPassphrase string
+	kKeys       = make(map[string][]byte)
+)
+
+// passphrase returns the passphrase of the tokens, from the environment
+// or the terminal, typed twice when confirm is set.
+func passphrase(confirm bool) (string, error) {
+	if kPassphrase != "" {
+		return kPassphrase, nil
+	}
+	if env := os.Getenv(kEnvPassphrase); env != "" {
+		kPassphrase = env
+		return env, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("tokens are encrypted, set " + kEnvPassphrase + " or run from a terminal")
+	}
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(first) == 0 {
+		return "", errors.New("empty passphrase")
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Passphrase again: ")
+		second, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(first, second) {
+			return "", errors.New("passphrases differ")
+		}
+	}
+	kPassphrase = string(first)
+	return kPassphrase, nil
+}
+
+// newEncryption returns the parameters of a new key.
+func newEncryption() (*tokenEncryption, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &tokenEncryption{KDF: "scrypt", Salt: salt, N: kScryptN, R: kScryptR, P: kScryptP}, nil
+}
+
+// aead returns the cipher of the key, asking for the passphrase.
+func (e *tokenEncryption) aead(confirm bool) (cipher.AEAD, error) {
+	if e.KDF != "scrypt" {
+		return nil, fmt.Errorf("unknown key derivation %q", e.KDF)
+	}
+	key, ok := kKeys[string(e.Salt)]
+	if !ok {
+		pass, err := passphrase(confirm)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = scrypt.Key([]byte(pass), e.Salt, e.N, e.R, e.P, 32); err != nil {
+			return nil, err
+		}
+		kKeys[string(e.Salt)] = key
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sections returns the parts of the config file by profile name.
+func (c *Config) sections() map[string]*Config {
+	sections := map[string]*Config{"": c}
+	for name, section := range c.Profiles {
+		if section != nil {
+			sections[name] = section
+		}
+	}
+	return sections
+}
+
+// credentialHelper returns the helper keeping the tokens of a section.
+func (c *Config) credentialHelper(section *Config) string {
+	if section.CredentialHelper != "" {
+		return section.CredentialHelper
+	}
+	return c.CredentialHelper
+}
+
+// openTokens fills in the tokens of profile name, when the config file c
+// keeps them encrypted or in a credential helper.
+func (c *Config) openTokens(name string) error {
+	section := c.section(name)
+	var token sealedToken
+	switch {
+	case c.credentialHelper(section) != "":
+		password, err := runCredentialHelper(c.credentialHelper(section), "get", name, "")
+		if err != nil || password == "" {
+			return err
+		}
+		if err := json.Unmarshal([]byte(password), &token); err != nil {
+			return fmt.Errorf("credential helper: %v", err)
+		}
+	case section.SealedTokens != nil:
+		if c.Encryption == nil {
+			return errors.New("config has sealed tokens but no encryption")
+		}
+		aead, err := c.Encryption.aead(false)
+		if err != nil {
+			return err
+		}
+		sealed := section.SealedTokens
+		if len(sealed) < aead.NonceSize() {
+			return errors.New("sealed tokens are truncated")
+		}
+		// The profile name is authenticated, sealed tokens can not be
+		// moved to another profile
+		plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+		if err != nil {
+			return errors.New("cannot decrypt the tokens, wrong passphrase?")
+		}
+		if err := json.Unmarshal(plain, &token); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	section.AccessToken, section.RefreshToken, section.TokenExpiry = token.AccessToken, token.RefreshToken, token.TokenExpiry
+	return nil
+}
+
+// openAllTokens is openTokens for every profile.
+func (c *Config) openAllTokens() error {
+	for name := range c.sections() {
+		if err := c.openTokens(name); err != nil {
+			return fmt.Errorf("profile %s: %v", profileLabel(name), err)
+		}
+	}
+	return nil
+}
+
+// sealTokens moves the tokens out of the plain fields of the profiles
+// that have them, into sealed_tokens or the credential helper when the
+// config keeps them there.
+func (c *Config) sealTokens() error {
+	sections := c.sections()
+	var names []string
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		section := sections[name]
+		if section.AccessToken == "" && section.RefreshToken == "" {
+			continue
+		}
+		token, err := json.Marshal(sealedToken{section.AccessToken, section.RefreshToken, section.TokenExpiry})
+		if err != nil {
+			return err
+		}
+		switch {
+		case c.credentialHelper(section) != "":
+			if _, err := runCredentialHelper(c.credentialHelper(section), "store", name, string(token)); err != nil {
+				return err
+			}
+			section.SealedTokens = nil
+		case c.Encryption != nil:
+			aead, err := c.Encryption.aead(false)
+			if err != nil {
+				return err
+			}
+			nonce := make([]byte, aead.NonceSize())
+			if _, err := rand.Read(nonce); err != nil {
+				return err
+			}
+			section.SealedTokens = aead.Seal(nonce, nonce, token, []byte(name))
+		default:
+			continue
+		}
+		section.AccessToken, section.RefreshToken, section.TokenExpiry = "", "", 0
+	}
+	return nil
+}
+
+// runCredentialHelper runs "helper get|store|erase" like git does, with
+// the profile as the username and the tokens as the password, and
+// returns the password the helper printed.
+func runCredentialHelper(helper string, operation string, profile string, password string) (string, error) {
+	input := "protocol=https\nhost=" + kCredentialHost + "\nusername=" + profileLabel(profile) + "\n"
+	if password != "" {
+		input += "password=" + password + "\n"
+	}
+	cmd := exec.Command("sh", "-c", helper+" "+operation)
+	cmd.Stdin = strings.NewReader(input + "\n")
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("credential helper %s: %v", operation, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if value := strings.TrimPrefix(scanner.Text(), "password="); value != scanner.Text() {
+			return value, nil
+		}
+	}
+	return "", nil
+}
+
+// profileLabel is the name of a profile as shown, "default" for "".
+func profileLabel(name string) string {
+	if name == "" {
+		return kDefaultProfile
+	}
+	return name
+}
+
+// configCommand runs gdbox config encrypt|decrypt.
+func configCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Illegal number of arguments.\nTry " + os.Args[0] + " -h for more information")
+	}
+	return updateConfig(kConfigPath, func(c *Config) error {
+		switch args[0] {
+		case "encrypt":
+			if c.Encryption != nil {
+				return errors.New("tokens are already encrypted")
+			}
+			if c.CredentialHelper != "" {
+				return errors.New("tokens are kept by the credential helper")
+			}
+			encryption, err := newEncryption()
+			if err != nil {
+				return err
+			}
+			// Derived now, so the passphrase is asked twice
+			if _, err := encryption.aead(true); err != nil {
+				return err
+			}
+			c.Encryption = encryption
+			fmt.Println("Tokens are now encrypted")
+		case "decrypt":
+			if c.Encryption == nil {
+				return errors.New("tokens are not encrypted")
+			}
+			if err := c.openAllTokens(); err != nil {
+				return err
+			}
+			c.Encryption = nil
+			for _, section := range c.sections() {
+				section.SealedTokens = nil
+			}
+			fmt.Println("Tokens are now stored in plain text")
+		default:
+			return fmt.Errorf("unknown config command %q, use encrypt or decrypt", args[0])
+		}
+		return nil
+	})
+}
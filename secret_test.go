@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// resetPassphrase forgets the passphrase and keys of earlier tests.
+func resetPassphrase(t *testing.T, pass string) {
+	kPassphrase, kKeys = "", make(map[string][]byte)
+	t.Setenv(kEnvPassphrase, pass)
+	t.Cleanup(func() { kPassphrase, kKeys = "", make(map[string][]byte) })
+}
+
+func TestEncryptedTokens(t *testing.T) {
+	kConfigPath = filepath.Join(t.TempDir(), "gdbox.conf")
+	defer func() { kConfigPath = "" }()
+	resetPassphrase(t, "secret")
+	config := &Config{AccessToken: "plain-a", RefreshToken: "refresh-a", Profiles: map[string]*Config{"work": {AccessToken: "plain-w"}}}
+	if err := config.SaveFile(kConfigPath); err != nil {
+		t.Fatal(err)
+	}
+
+	run(t, "", "config", "encrypt")
+	data, err := ioutil.ReadFile(kConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "plain-") || strings.Contains(string(data), "refresh-a") {
+		t.Fatalf("tokens in the clear:\n%s", data)
+	}
+	if info, _ := os.Stat(kConfigPath); info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v", info.Mode())
+	}
+	if err := configCommand([]string{"encrypt"}); err == nil {
+		t.Error("encrypted twice")
+	}
+
+	load := func() *Config {
+		t.Helper()
+		var c Config
+		if err := c.LoadFile(kConfigPath); err != nil {
+			t.Fatal(err)
+		}
+		return &c
+	}
+	c := load()
+	if err := c.openTokens("work"); err != nil || c.Profiles["work"].AccessToken != "plain-w" {
+		t.Fatalf("open work = %q, %v", c.Profiles["work"].AccessToken, err)
+	}
+	// Sealed for another profile, the name does not authenticate
+	c.SealedTokens = c.Profiles["work"].SealedTokens
+	if err := c.openTokens(""); err == nil {
+		t.Error("opened the tokens of work as the default profile")
+	}
+
+	resetPassphrase(t, "wrong")
+	if err := load().openTokens(""); err == nil {
+		t.Error("opened with a wrong passphrase")
+	}
+
+	resetPassphrase(t, "secret")
+	run(t, "", "config", "decrypt")
+	c = load()
+	if c.Encryption != nil || c.AccessToken != "plain-a" || c.RefreshToken != "refresh-a" || c.Profiles["work"].AccessToken != "plain-w" {
+		t.Fatalf("after decrypt: %+v", c)
+	}
+}
+
+func TestCredentialHelper(t *testing.T) {
+	dir := t.TempDir()
+	kConfigPath = filepath.Join(dir, "gdbox.conf")
+	defer func() { kConfigPath = "" }()
+	// Keeps the last password stored by username, in a file of its own
+	helper := filepath.Join(dir, "helper.sh")
+	script := `#!/bin/sh
+store="` + dir + `/store"
+while read -r line; do
+	case "$line" in
+	username=*) user="${line#username=}" ;;
+	password=*) pass="${line#password=}" ;;
+	esac
+done
+case "$1" in
+get) if [ -f "$store.$user" ]; then printf 'password=%s\n' "$(cat "$store.$user")"; fi ;;
+store) printf '%s' "$pass" > "$store.$user" ;;
+erase) rm -f "$store.$user" ;;
+esac
+`
+	if err := ioutil.WriteFile(helper, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{CredentialHelper: helper, AccessToken: "plain-a", TokenExpiry: 42}
+	if err := config.SaveFile(kConfigPath); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(kConfigPath); strings.Contains(string(data), "plain-a") {
+		t.Fatalf("token in the clear:\n%s", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "store.default")); err != nil {
+		t.Fatal("helper did not store the token:", err)
+	}
+
+	var c Config
+	if err := c.LoadFile(kConfigPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.openTokens(""); err != nil || c.AccessToken != "plain-a" || c.TokenExpiry != 42 {
+		t.Fatalf("open = %+v, %v", c, err)
+	}
+	if state := c.loginState(kDefaultProfile); state != "logged in, in the credential helper" {
+		t.Errorf("login state %q", state)
+	}
+	// Nothing stored for the profile is not an error, it is logged out
+	c.section("work")
+	if state := c.loginState("work"); state != "not logged in" {
+		t.Errorf("login state of work %q", state)
+	}
+	if err := c.openTokens("work"); err != nil || c.Profiles["work"].AccessToken != "" {
+		t.Fatalf("open work = %q, %v", c.Profiles["work"].AccessToken, err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/isyangban/gdbox/lib"
+)
+
+// kLockWait is how long to wait for the lock of the config file.
+const kLockWait = 10 * time.Second
+
+// configStore saves refreshed tokens to a profile of the config file,
+// which other gdbox processes may be refreshing at the same time.
+type configStore struct {
+	path    string
+	profile string
+}
+
+func (s configStore) Update(refresh func(stored lib.Token) (lib.Token, error)) (lib.Token, error) {
+	var token lib.Token
+	err := updateConfig(s.path, func(c *Config) error {
+		var err error
+		if err := c.openTokens(s.profile); err != nil {
+			return err
+		}
+		section := c.section(s.profile)
+		token, err = refresh(*section.ToToken())
+		if err == nil {
+			section.setToken(token)
+		}
+		return err
+	})
+	if err != nil {
+		return lib.Token{}, err
+	}
+	kConfig.setToken(token)
+	return token, nil
+}
+
+// updateConfig changes the config file with update while holding its
+// lock. The file is read again first, another process may have changed
+// it since kConfig was loaded. Nothing happens when config_path is "".
+func updateConfig(config_path string, update func(c *Config) error) error {
+	if config_path == "" {
+		return nil
+	}
+	unlock, err := lockFile(config_path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	c := new(Config)
+	if err := c.LoadFile(config_path); err != nil && !errors.Is(err, errNoConfig) {
+		return err
+	}
+	if err := update(c); err != nil {
+		return err
+	}
+	return c.SaveFile(config_path)
+}
+
+// lockFile locks lock_path, waiting while another process has it, and
+// returns the function that unlocks it. The lock is the operating
+// system's, a gdbox that dies leaves none behind. The file stays, as
+// removing it would let another process lock a file that is no longer
+// at lock_path.
+func lockFile(lock_path string) (func(), error) {
+	f, err := os.OpenFile(lock_path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(kLockWait)
+	for {
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if locked {
+			return func() { f.Close() }, nil
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("%s is held by another gdbox", lock_path)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// tryLock takes the lock of f without waiting, it reports false when
+// another process has it.
+func tryLock(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}